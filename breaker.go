@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen fails the downloads that are not attempted because the
+// circuit breaker tripped.
+var errCircuitOpen = errors.New("not attempted: circuit breaker open after too many consecutive failures")
+
+// Circuit breaker states.
+const (
+	breakerClosed = iota // downloads run normally
+	breakerOpen          // tripped; waiting out the cooldown, then probing
+	breakerDead          // tripped for good; everything left fails at once
+)
+
+// circuitBreaker stops a run from grinding through every remaining key
+// against a backend that is down. After threshold consecutive failures it
+// trips. With no cooldown every download not yet started then fails at
+// once; otherwise downloads wait out the cooldown, a single probe is let
+// through, and its outcome either closes the breaker again or trips it for
+// good.
+type circuitBreaker struct {
+	logger    *log.Logger
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	probing  bool
+	// changed is closed, and replaced, whenever the state changes.
+	changed chan struct{}
+}
+
+func newCircuitBreaker(logger *log.Logger, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{logger: logger, threshold: threshold, cooldown: cooldown, changed: make(chan struct{})}
+}
+
+// allow blocks until a download may start, and reports whether it is the
+// probe whose outcome decides whether the breaker closes. It returns
+// errCircuitOpen once the breaker has tripped for good.
+func (b *circuitBreaker) allow(ctx context.Context) (probe bool, err error) {
+	for {
+		b.mu.Lock()
+		switch b.state {
+		case breakerClosed:
+			b.mu.Unlock()
+			return false, nil
+		case breakerDead:
+			b.mu.Unlock()
+			return false, errCircuitOpen
+		}
+		wait := time.Until(b.openedAt.Add(b.cooldown))
+		if wait <= 0 && !b.probing {
+			b.probing = true
+			b.mu.Unlock()
+			b.logger.Printf("Circuit breaker cooldown over, probing with one download")
+			return true, nil
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+	}
+}
+
+// record feeds a finished download's outcome into the breaker. Throttling
+// doesn't count as a failure: the backend is up, just busy. A 304 for a
+// conditional request counts as a success.
+func (b *circuitBreaker) record(probe bool, err error) {
+	if isThrottle(err) {
+		return
+	}
+	if isNotModified(err) {
+		err = nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = false
+		if err == nil {
+			b.logger.Printf("Circuit breaker probe succeeded, resuming downloads")
+			b.set(breakerClosed)
+		} else {
+			b.logger.Printf("Circuit breaker probe failed, failing all remaining downloads: %v", err)
+			b.set(breakerDead)
+		}
+		return
+	}
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state != breakerClosed || b.failures < b.threshold {
+		return
+	}
+	if b.cooldown <= 0 {
+		b.logger.Printf("Circuit breaker tripped after %d consecutive failures, failing all remaining downloads", b.failures)
+		b.set(breakerDead)
+		return
+	}
+	b.logger.Printf("Circuit breaker tripped after %d consecutive failures, pausing downloads for %s", b.failures, b.cooldown)
+	b.openedAt = time.Now()
+	b.set(breakerOpen)
+}
+
+// set moves to state and wakes every waiting download. The caller holds
+// b.mu.
+func (b *circuitBreaker) set(state int) {
+	b.state = state
+	b.failures = 0
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
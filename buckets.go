@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// bucketTarget is one bucket given to -bucket, optionally with the prefix to
+// list in it.
+type bucketTarget struct {
+	bucket string
+	prefix string
+}
+
+// bucketFlag collects repeated -bucket values of the form bucket or
+// bucket:prefix. Bucket names can't contain ':', so everything after the
+// first one is the prefix.
+type bucketFlag []bucketTarget
+
+func (f *bucketFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	parts := make([]string, len(*f))
+	for i, t := range *f {
+		parts[i] = t.bucket
+		if t.prefix != "" {
+			parts[i] += ":" + t.prefix
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *bucketFlag) Set(value string) error {
+	bucket, prefix, _ := strings.Cut(value, ":")
+	if bucket == "" {
+		return fmt.Errorf("missing bucket name in %q", value)
+	}
+	for _, t := range *f {
+		if t.bucket == bucket {
+			return fmt.Errorf("bucket %s given more than once", bucket)
+		}
+	}
+	*f = append(*f, bucketTarget{bucket: bucket, prefix: prefix})
+	return nil
+}
+
+// regionClients finds the region of each bucket of a multi-bucket run and
+// hands out an S3 client for it, so buckets outside the configured region
+// work too. Regions are looked up once per bucket and clients built once
+// per region, for the whole run.
+type regionClients struct {
+	cfg  aws.Config
+	opts options
+	base *s3.Client
+
+	mu      sync.Mutex
+	regions map[string]string
+	clients map[string]*s3.Client
+}
+
+// newRegionClients starts with base, the client for cfg's own region.
+func newRegionClients(cfg aws.Config, opts options, base *s3.Client) *regionClients {
+	return &regionClients{
+		cfg:     cfg,
+		opts:    opts,
+		base:    base,
+		regions: make(map[string]string),
+		clients: map[string]*s3.Client{cfg.Region: base},
+	}
+}
+
+// resolve looks up the regions of every bucket not looked up yet, up to
+// workers at a time. GetBucketRegion asks with one unsigned HeadBucket,
+// which needs no permission on the bucket. A bucket whose region can't be
+// found is logged and left to the configured region.
+func (r *regionClients) resolve(ctx context.Context, logger *log.Logger, buckets []string, workers int) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+	for _, bucket := range buckets {
+		r.mu.Lock()
+		_, known := r.regions[bucket]
+		r.mu.Unlock()
+		if known {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			region, err := manager.GetBucketRegion(ctx, r.base, bucket)
+			if err != nil {
+				logger.Printf("Warning: could not find the region of s3://%s, using %s: %v", bucket, r.cfg.Region, err)
+				region = r.cfg.Region
+			}
+			r.mu.Lock()
+			r.regions[bucket] = region
+			r.mu.Unlock()
+		}()
+	}
+	wg.Wait()
+}
+
+// client returns the client for bucket's region, building it on first use.
+// The bucket must have been resolved.
+func (r *regionClients) client(bucket string) *s3.Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	region, ok := r.regions[bucket]
+	if !ok {
+		return r.base
+	}
+	if c, ok := r.clients[region]; ok {
+		return c
+	}
+	// -signing-region is the region to sign for in the configured one;
+	// a bucket found elsewhere is signed for, and routed to, its own.
+	cfg := r.cfg.Copy()
+	cfg.Region = region
+	opts := r.opts
+	opts.signingRegion = ""
+	c := newS3Client(cfg, opts)
+	r.clients[region] = c
+	return c
+}
+
+// mappings returns the bucket regions resolved so far.
+func (r *regionClients) mappings() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := make(map[string]string, len(r.regions))
+	for bucket, region := range r.regions {
+		m[bucket] = region
+	}
+	return m
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Policies for -case-collisions, applied when two keys map to local paths
+// that differ only by case on a case-insensitive filesystem.
+const (
+	caseCollisionRename = "rename"
+	caseCollisionWarn   = "warn"
+)
+
+// caseInsensitive reports whether dir is on a filesystem that treats names
+// differing only by case as the same file, as macOS and Windows do by
+// default. It finds out by creating a probe file and looking it up again
+// under a lower-cased name.
+func caseInsensitive(dir string) (bool, error) {
+	probe, err := os.CreateTemp(dir, ".CaseProbe*")
+	if err != nil {
+		return false, err
+	}
+	probe.Close()
+	defer os.Remove(probe.Name())
+
+	info, err := os.Stat(probe.Name())
+	if err != nil {
+		return false, err
+	}
+	lower, err := os.Stat(filepath.Join(dir, strings.ToLower(filepath.Base(probe.Name()))))
+	if err != nil {
+		return false, nil
+	}
+	return os.SameFile(info, lower), nil
+}
+
+// caseCollisions finds the keys whose local paths differ only by case from
+// the path of another key. Keys are taken in sorted order so the result is
+// the same from run to run: the first keeps its path, and every later one
+// is mapped to a numbered variant of it, such as data~2.json.gz, that
+// collides with nothing else. Keys without a valid local path are left to
+// downloadFiles to report.
+func caseCollisions(localDir string, keys []string, tmpl *outputTemplate) map[string]string {
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+
+	paths := make(map[string]string, len(sorted))
+	taken := make(map[string]bool, len(sorted))
+	for _, key := range sorted {
+		p, err := targetPath(localDir, key, tmpl)
+		if err != nil {
+			continue
+		}
+		paths[key] = p
+		taken[strings.ToLower(p)] = true
+	}
+
+	renamed := make(map[string]string)
+	claimed := make(map[string]bool, len(paths))
+	for _, key := range sorted {
+		p, ok := paths[key]
+		if !ok {
+			continue
+		}
+		if !claimed[strings.ToLower(p)] {
+			claimed[strings.ToLower(p)] = true
+			continue
+		}
+		for n := 2; ; n++ {
+			alt := numberedPath(p, n)
+			if folded := strings.ToLower(alt); !taken[folded] {
+				taken[folded] = true
+				claimed[folded] = true
+				renamed[key] = alt
+				break
+			}
+		}
+	}
+	return renamed
+}
+
+// numberedPath inserts ~n before path's extension, keeping the
+// matchSuffix whole so the file is still picked up for decompression.
+func numberedPath(path string, n int) string {
+	ext := filepath.Ext(path)
+	if strings.HasSuffix(path, matchSuffix) {
+		ext = matchSuffix
+	}
+	return fmt.Sprintf("%s~%d%s", strings.TrimSuffix(path, ext), n, ext)
+}
+
+// resolveCaseCollisions returns the local paths to use instead of the usual
+// ones for keys that would overwrite each other in localDir. On a
+// case-sensitive filesystem there are none. With caseCollisionWarn every
+// collision is only logged and nothing is renamed.
+func resolveCaseCollisions(logger *log.Logger, localDir string, keys []string, tmpl *outputTemplate, policy string) map[string]string {
+	insensitive, err := caseInsensitive(localDir)
+	if err != nil {
+		logger.Printf("Warning: could not tell whether %s is case-insensitive, assuming it isn't: %v", localDir, err)
+		return nil
+	}
+	if !insensitive {
+		return nil
+	}
+	renamed := caseCollisions(localDir, keys, tmpl)
+	if len(renamed) == 0 {
+		return nil
+	}
+	collided := make([]string, 0, len(renamed))
+	for key := range renamed {
+		collided = append(collided, key)
+	}
+	sort.Strings(collided)
+	for _, key := range collided {
+		if policy == caseCollisionWarn {
+			logger.Printf("Warning: %s differs only by case from another key and will overwrite its local copy", key)
+		} else {
+			logger.Printf("Saving %s as %s: its local path differs only by case from another key's", key, renamed[key])
+		}
+	}
+	logger.Printf("%d key(s) collide with another key on the case-insensitive filesystem at %s", len(renamed), localDir)
+	if policy == caseCollisionWarn {
+		return nil
+	}
+	return renamed
+}
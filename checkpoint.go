@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// checkpoint is the progress of a run saved in the -state-file as it goes:
+// the objects of Bucket already downloaded, by key, with the ETag they had.
+type checkpoint struct {
+	Bucket    string            `json:"bucket"`
+	Completed map[string]string `json:"completed"`
+}
+
+// completed returns the objects of bucket the checkpoint in st records as
+// downloaded, if any.
+func (st runState) completed(bucket string) map[string]string {
+	if st.Checkpoint == nil || st.Checkpoint.Bucket != bucket {
+		return nil
+	}
+	return st.Checkpoint.Completed
+}
+
+// checkpointer saves a checkpoint of the downloads finished so far to the
+// -state-file every interval, and after every files more of them when files
+// is positive, so a run that dies part way is resumed by the next one
+// instead of started over. Saves happen on a goroutine of their own, one at a
+// time, so downloads never wait for the disk.
+type checkpointer struct {
+	logger *log.Logger
+	path   string
+	files  int
+	etags  map[string]string
+
+	mu      sync.Mutex
+	state   runState
+	unsaved int
+	saved   int
+	err     error
+
+	kick    chan struct{}
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+// startCheckpointer checkpoints the downloads of objects, on top of what
+// state already records as completed in bucket.
+func startCheckpointer(logger *log.Logger, path, bucket string, state runState, objects []types.Object, interval time.Duration, files int) *checkpointer {
+	c := &checkpointer{
+		logger: logger,
+		path:   path,
+		files:  files,
+		etags:  make(map[string]string, len(objects)),
+		state:  state,
+		kick:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+	for _, obj := range objects {
+		c.etags[aws.ToString(obj.Key)] = aws.ToString(obj.ETag)
+	}
+	completed := make(map[string]string, len(state.completed(bucket))+len(objects))
+	for key, etag := range state.completed(bucket) {
+		completed[key] = etag
+	}
+	c.state.Checkpoint = &checkpoint{Bucket: bucket, Completed: completed}
+
+	c.stopped.Add(1)
+	go c.loop(interval)
+	return c
+}
+
+// loop saves on every tick, and whenever hook asks for it, until stopped.
+func (c *checkpointer) loop(interval time.Duration) {
+	defer c.stopped.Done()
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+			c.save()
+		case <-c.kick:
+			c.save()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// hook has the shape of downloadOptions.onComplete and records key as
+// completed when it arrived, or turned out to be a duplicate.
+func (c *checkpointer) hook(key, _ string, err error) {
+	if err != nil && !errors.Is(err, errDuplicate) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state.Checkpoint.Completed[key] = c.etags[key]
+	c.unsaved++
+	if c.files > 0 && c.unsaved >= c.files {
+		select {
+		case c.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// save writes the checkpoint if anything completed since the last one. A
+// failed save is logged once and tried again next time.
+func (c *checkpointer) save() {
+	c.mu.Lock()
+	if c.unsaved == 0 {
+		c.mu.Unlock()
+		return
+	}
+	data, err := encodeState(c.state)
+	n := len(c.state.Checkpoint.Completed)
+	c.unsaved = 0
+	c.mu.Unlock()
+
+	if err == nil {
+		err = writeState(c.path, data)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		if c.err == nil {
+			c.logger.Printf("Warning: failed to save checkpoint: %v", err)
+		}
+		c.err = err
+		c.unsaved++
+		return
+	}
+	c.err = nil
+	c.saved = n
+}
+
+// close saves the last checkpoint and returns its error, if it failed.
+func (c *checkpointer) close() error {
+	close(c.stop)
+	c.stopped.Wait()
+	c.save()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil && c.saved > 0 {
+		c.logger.Printf("Checkpointed %d completed files in %s", c.saved, c.path)
+	}
+	return c.err
+}
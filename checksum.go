@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// checksumWriter records the SHA-256 of every file decompressed in this run,
+// one line each in the format sha256sum -c reads: the hex digest, two
+// spaces and the path relative to root, with '/' separators.
+type checksumWriter struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	root string
+	err  error
+}
+
+func newChecksumWriter(path, root string) (*checksumWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create checksum manifest: %w", err)
+	}
+	return &checksumWriter{file: file, w: bufio.NewWriter(file), root: root}, nil
+}
+
+// add records sum for the file at path. Calls may come from several
+// decompression workers at once.
+func (c *checksumWriter) add(path string, sum []byte) {
+	rel, err := filepath.Rel(c.root, path)
+	if err != nil {
+		rel = path
+	}
+	name := filepath.ToSlash(rel)
+	prefix := ""
+	// sha256sum escapes names containing a backslash or newline and marks
+	// the line with a leading backslash.
+	if strings.ContainsAny(name, "\\\n") {
+		name = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(name)
+		prefix = "\\"
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	if _, c.err = fmt.Fprintf(c.w, "%s%s  %s\n", prefix, hex.EncodeToString(sum), name); c.err == nil {
+		c.err = c.w.Flush()
+	}
+}
+
+func (c *checksumWriter) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.file.Close(); c.err == nil {
+		c.err = err
+	}
+	if c.err != nil {
+		return fmt.Errorf("write checksum manifest: %w", c.err)
+	}
+	return nil
+}
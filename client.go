@@ -0,0 +1,280 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go-v2/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyendpoints "github.com/aws/smithy-go/endpoints"
+)
+
+// Values for -credentials-source. The empty string means the SDK's default
+// chain.
+const (
+	credSourceEnv     = "env"
+	credSourceProfile = "profile"
+	credSourceEC2     = "ec2"
+	credSourceECS     = "ecs"
+)
+
+// ecsCredentialsHost is where the ECS agent serves task role credentials for
+// AWS_CONTAINER_CREDENTIALS_RELATIVE_URI.
+const ecsCredentialsHost = "http://169.254.170.2"
+
+// defaultEndpointRegion is used when -endpoint points at an S3-compatible
+// store and no region was configured. Such stores usually ignore the region,
+// but the SDK still needs one to sign requests.
+const defaultEndpointRegion = "us-east-1"
+
+// loadAWSConfig resolves the SDK config for opts. Precedence is:
+//
+//   - region: -region, then AWS_REGION, then the profile's region; if none is
+//     set it is an error rather than a silent default.
+//   - profile: -profile, then AWS_PROFILE, then "default".
+//
+// With a custom -endpoint a missing region falls back to
+// defaultEndpointRegion instead of failing.
+//
+// The environment and profile steps are the SDK's own resolution order; only
+// the explicit flags are layered on top.
+//
+// Loading the config and fetching the first set of credentials share
+// opts.credentialsTimeout, so a slow or unreachable metadata endpoint fails
+// the run promptly instead of hanging it.
+func loadAWSConfig(ctx context.Context, opts options) (aws.Config, error) {
+	if opts.credentialsTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.credentialsTimeout)
+		defer cancel()
+	}
+
+	var loadOpts []func(*config.LoadOptions) error
+	if opts.profile != "" {
+		loadOpts = append(loadOpts, config.WithSharedConfigProfile(opts.profile))
+	}
+	if opts.region != "" {
+		loadOpts = append(loadOpts, config.WithRegion(opts.region))
+	}
+	if opts.sharedCredentialsFile != "" {
+		loadOpts = append(loadOpts, config.WithSharedCredentialsFiles([]string{opts.sharedCredentialsFile}))
+	}
+	if opts.sharedConfigFile != "" {
+		loadOpts = append(loadOpts, config.WithSharedConfigFiles([]string{opts.sharedConfigFile}))
+	}
+	if opts.maxIdleConnsPerHost > 0 {
+		loadOpts = append(loadOpts, config.WithHTTPClient(awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+			tr.MaxIdleConnsPerHost = opts.maxIdleConnsPerHost
+			tr.MaxIdleConns = max(tr.MaxIdleConns, opts.maxIdleConnsPerHost)
+		})))
+	}
+	if opts.accessKey != "" {
+		loadOpts = append(loadOpts, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(opts.accessKey, opts.secretKey, opts.sessionToken)))
+	}
+
+	if opts.credentialsSource == credSourceProfile {
+		ignoreEnvCredentials()
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, loadOpts...)
+	var missing config.SharedConfigProfileNotExistError
+	if errors.As(err, &missing) {
+		return aws.Config{}, fmt.Errorf("profile %q not found in %s: %w", missing.Profile, sharedFilesDescription(opts), err)
+	}
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("load SDK config: %w", err)
+	}
+	if cfg.Region == "" && opts.endpoint != "" {
+		cfg.Region = defaultEndpointRegion
+	}
+	if cfg.Region == "" {
+		return aws.Config{}, errors.New("no region configured: pass -region, set AWS_REGION, or set a region in the AWS profile")
+	}
+
+	if err := applyCredentialSource(&cfg, opts.credentialsSource); err != nil {
+		return aws.Config{}, err
+	}
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return aws.Config{}, fmt.Errorf("timed out after %s waiting for AWS credentials; check the metadata endpoint or pick a source with -credentials-source: %w", opts.credentialsTimeout, err)
+		}
+		return aws.Config{}, fmt.Errorf("retrieve AWS credentials: %w", err)
+	}
+	if opts.credentialsSource == credSourceProfile && (creds.Source == ec2rolecreds.ProviderName || creds.Source == endpointcreds.ProviderName) {
+		return aws.Config{}, fmt.Errorf("-credentials-source=profile: the profile has no credentials (the SDK fell back to %s)", creds.Source)
+	}
+	return cfg, nil
+}
+
+// applyCredentialSource replaces the default credential chain on cfg with a
+// single provider when -credentials-source asks for one.
+func applyCredentialSource(cfg *aws.Config, source string) error {
+	switch source {
+	case "", credSourceProfile:
+		// The profile is resolved by LoadDefaultConfig; see loadAWSConfig.
+		return nil
+	case credSourceEnv:
+		id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if id == "" || secret == "" {
+			return errors.New("-credentials-source=env: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+		}
+		cfg.Credentials = credentials.NewStaticCredentialsProvider(id, secret, os.Getenv("AWS_SESSION_TOKEN"))
+	case credSourceEC2:
+		cfg.Credentials = aws.NewCredentialsCache(ec2rolecreds.New())
+	case credSourceECS:
+		endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+		if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); endpoint == "" && rel != "" {
+			endpoint = ecsCredentialsHost + rel
+		}
+		if endpoint == "" {
+			return errors.New("-credentials-source=ecs: neither AWS_CONTAINER_CREDENTIALS_RELATIVE_URI nor AWS_CONTAINER_CREDENTIALS_FULL_URI is set")
+		}
+		token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+		if path := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("-credentials-source=ecs: read authorization token: %w", err)
+			}
+			token = strings.TrimSpace(string(data))
+		}
+		cfg.Credentials = aws.NewCredentialsCache(endpointcreds.New(endpoint, func(o *endpointcreds.Options) {
+			o.AuthorizationToken = token
+		}))
+	default:
+		return fmt.Errorf("invalid -credentials-source %q: must be env, profile, ec2 or ecs", source)
+	}
+	return nil
+}
+
+// sharedFilesDescription names the shared config and credentials files the
+// SDK reads for opts, for error messages.
+func sharedFilesDescription(opts options) string {
+	credsFile, configFile := opts.sharedCredentialsFile, opts.sharedConfigFile
+	if credsFile == "" {
+		credsFile = cmp.Or(os.Getenv("AWS_SHARED_CREDENTIALS_FILE"), config.DefaultSharedCredentialsFilename())
+	}
+	if configFile == "" {
+		configFile = cmp.Or(os.Getenv("AWS_CONFIG_FILE"), config.DefaultSharedConfigFilename())
+	}
+	return credsFile + " or " + configFile
+}
+
+// ignoreEnvCredentials unsets the static credential variables so that
+// LoadDefaultConfig, which always prefers them, resolves the profile's
+// credentials instead. The SDK has no option to skip that step.
+func ignoreEnvCredentials() {
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY", "AWS_SESSION_TOKEN"} {
+		os.Unsetenv(name)
+	}
+}
+
+// newS3Client builds the S3 client for cfg. A custom endpoint, templated or
+// not, switches to path-style addressing, which MinIO, Ceph and most other
+// S3-compatible stores expect. signingRegion overrides the region used in
+// the SigV4 signature for gateways that validate a specific value.
+func newS3Client(cfg aws.Config, opts options) *s3.Client {
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		switch {
+		case isEndpointTemplate(opts.endpoint):
+			o.EndpointResolverV2 = endpointTemplate{
+				template: opts.endpoint,
+				next:     s3.NewDefaultEndpointResolverV2(),
+			}
+			o.UsePathStyle = true
+		case opts.endpoint != "":
+			o.BaseEndpoint = aws.String(opts.endpoint)
+			o.UsePathStyle = true
+		}
+		if opts.signingRegion != "" {
+			o.Region = opts.signingRegion
+		}
+		addRequestHeaders(o, opts.headers)
+	})
+}
+
+// defaultIdleConnsPerHost is how many idle connections per host the SDK's
+// HTTP client keeps by default. A download concurrency above it makes every
+// burst past that number open, and TLS handshake, new connections.
+const defaultIdleConnsPerHost = 10
+
+// warmConnections opens n connections to bucket's endpoint before the
+// downloads start, so the first batch doesn't pay for the TLS handshakes, by
+// sending n HeadBucket requests at once. They are left idle in the pool for
+// the downloads to reuse. A HeadBucket S3 refuses still leaves its
+// connection open, so failures are only logged with verbose.
+func warmConnections(ctx context.Context, logger *log.Logger, svc *s3.Client, bucket string, n int, verbose bool) {
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := svc.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+			if err != nil && verbose {
+				logger.Printf("Warming a connection to s3://%s: %v", bucket, err)
+			}
+		}()
+	}
+	wg.Wait()
+	logger.Printf("Warmed %d connection(s) to s3://%s", n, bucket)
+}
+
+// Tokens an -endpoint may contain, for federated S3-compatible deployments
+// that serve each bucket or region from its own cluster.
+const (
+	endpointBucketToken = "{bucket}"
+	endpointRegionToken = "{region}"
+)
+
+func isEndpointTemplate(endpoint string) bool {
+	return strings.Contains(endpoint, endpointBucketToken) || strings.Contains(endpoint, endpointRegionToken)
+}
+
+// validateEndpoint checks that endpoint, with any tokens filled in, is an
+// absolute URL.
+func validateEndpoint(endpoint string) error {
+	rendered := strings.NewReplacer(endpointBucketToken, "bucket", endpointRegionToken, "region").Replace(endpoint)
+	u, err := url.Parse(rendered)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute URL such as http://localhost:9000", endpoint)
+	}
+	return nil
+}
+
+// endpointTemplate resolves every request against its own rendering of an
+// -endpoint template: {bucket} is the request's bucket and {region} the
+// region it is signed for. The rendered URL is then resolved as a custom
+// endpoint would be.
+type endpointTemplate struct {
+	template string
+	next     s3.EndpointResolverV2
+}
+
+func (r endpointTemplate) ResolveEndpoint(ctx context.Context, params s3.EndpointParameters) (smithyendpoints.Endpoint, error) {
+	bucket := aws.ToString(params.Bucket)
+	if bucket == "" && strings.Contains(r.template, endpointBucketToken) {
+		return smithyendpoints.Endpoint{}, fmt.Errorf("endpoint %s needs a bucket, but the request has none", r.template)
+	}
+	params.Endpoint = aws.String(strings.NewReplacer(
+		endpointBucketToken, bucket,
+		endpointRegionToken, aws.ToString(params.Region),
+	).Replace(r.template))
+	return r.next.ResolveEndpoint(ctx, params)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestLoadAWSConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config")
+	os.WriteFile(configFile, []byte("[default]\nregion = eu-west-1\n\n[profile other]\nregion = ap-south-1\n\n[profile noregion]\n"), 0o600)
+	credsFile := filepath.Join(dir, "credentials")
+	os.WriteFile(credsFile, []byte("[default]\naws_access_key_id = AKID\naws_secret_access_key = SECRET\n\n[other]\naws_access_key_id = AKID\naws_secret_access_key = SECRET\n\n[noregion]\naws_access_key_id = AKID\naws_secret_access_key = SECRET\n"), 0o600)
+
+	tests := []struct {
+		name       string
+		region     string
+		profile    string
+		endpoint   string
+		envRegion  string
+		envProfile string
+		want       string
+		wantErr    bool
+	}{
+		{name: "flag over env and profile", region: "us-west-2", envRegion: "eu-central-1", want: "us-west-2"},
+		{name: "env over profile", envRegion: "eu-central-1", want: "eu-central-1"},
+		{name: "default profile", want: "eu-west-1"},
+		{name: "-profile", profile: "other", want: "ap-south-1"},
+		{name: "AWS_PROFILE", envProfile: "other", want: "ap-south-1"},
+		{name: "-profile over AWS_PROFILE", profile: "default", envProfile: "other", want: "eu-west-1"},
+		{name: "env over -profile region", profile: "other", envRegion: "eu-central-1", want: "eu-central-1"},
+		{name: "no region", profile: "noregion", wantErr: true},
+		{name: "no region with endpoint", profile: "noregion", endpoint: "http://localhost:9000", want: defaultEndpointRegion},
+	}
+	t.Setenv("AWS_CONFIG_FILE", configFile)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credsFile)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AWS_REGION", tt.envRegion)
+			t.Setenv("AWS_DEFAULT_REGION", "")
+			t.Setenv("AWS_PROFILE", tt.envProfile)
+			t.Setenv("AWS_DEFAULT_PROFILE", "")
+			opts := options{region: tt.region, profile: tt.profile, endpoint: tt.endpoint}
+			cfg, err := loadAWSConfig(context.Background(), opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got region %q, want an error", cfg.Region)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Region != tt.want {
+				t.Errorf("region = %q, want %q", cfg.Region, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadAWSConfigMissingProfile(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config")
+	os.WriteFile(configFile, []byte("[default]\nregion = eu-west-1\n"), 0o600)
+	t.Setenv("AWS_CONFIG_FILE", configFile)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", configFile)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "SECRET")
+	t.Setenv("AWS_PROFILE", "")
+	opts := options{profile: "absent", region: "us-east-1"}
+	if _, err := loadAWSConfig(context.Background(), opts); err == nil {
+		t.Fatal("missing -profile loaded without an error")
+	}
+}
+
+func TestRegionClientsRenderResolvedRegion(t *testing.T) {
+	var mu sync.Mutex
+	var paths, scopes []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/far") {
+			w.Header().Set("X-Amz-Bucket-Region", "eu-west-1")
+			return
+		}
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		scopes = append(scopes, r.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Header().Set("Content-Length", "0")
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	}
+	opts := options{endpoint: srv.URL + "/{region}", signingRegion: "gateway"}
+	regions := newRegionClients(cfg, opts, newS3Client(cfg, opts))
+	regions.resolve(context.Background(), discardLogger(), []string{"far"}, 1)
+	if got := regions.mappings()["far"]; got != "eu-west-1" {
+		t.Fatalf("far resolved to %q, want eu-west-1", got)
+	}
+	_, err := regions.client("far").HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String("far"),
+		Key:    aws.String("a.json.gz"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 || paths[0] != "/eu-west-1/far/a.json.gz" {
+		t.Errorf("requests went to %q, want /eu-west-1/far/a.json.gz", paths)
+	}
+	if len(scopes) != 1 || !strings.Contains(scopes[0], "/eu-west-1/s3/aws4_request") {
+		t.Errorf("signed as %q, want the eu-west-1 scope", scopes)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/smithy-go"
+)
+
+// credentialRefreshInterval is how often expired credentials are reloaded
+// at most. Downloads running at once tend to hit an expired token together;
+// all but the first just retry with what that one loaded.
+const credentialRefreshInterval = 30 * time.Second
+
+// refreshableCredentials lets a run swap in freshly loaded credentials when
+// S3 reports the current ones expired. The SDK refreshes credentials with
+// a known expiry by itself, but static or externally assumed ones never
+// change, so a multi-hour run outlives them. Reloading the config picks up
+// whatever the profile, credential process or environment provides now.
+type refreshableCredentials struct {
+	// cache is what clients use. Being a CredentialsCache, it isn't
+	// wrapped again by the S3 client, so invalidating it takes effect.
+	cache  *aws.CredentialsCache
+	reload func(ctx context.Context) (aws.CredentialsProvider, error)
+
+	mu          sync.Mutex
+	provider    aws.CredentialsProvider
+	lastRefresh time.Time
+}
+
+func newRefreshableCredentials(provider aws.CredentialsProvider, reload func(ctx context.Context) (aws.CredentialsProvider, error)) *refreshableCredentials {
+	r := &refreshableCredentials{provider: provider, reload: reload}
+	r.cache = aws.NewCredentialsCache(aws.CredentialsProviderFunc(r.retrieve))
+	return r
+}
+
+func (r *refreshableCredentials) retrieve(ctx context.Context) (aws.Credentials, error) {
+	r.mu.Lock()
+	p := r.provider
+	r.mu.Unlock()
+	return p.Retrieve(ctx)
+}
+
+// refresh reloads the credentials unless that was done within the last
+// credentialRefreshInterval.
+func (r *refreshableCredentials) refresh(ctx context.Context, logger *log.Logger) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.lastRefresh) < credentialRefreshInterval {
+		return nil
+	}
+	p, err := r.reload(ctx)
+	if err != nil {
+		return err
+	}
+	r.provider = p
+	r.lastRefresh = time.Now()
+	r.cache.Invalidate()
+	logger.Printf("Reloaded AWS credentials after S3 reported them expired")
+	return nil
+}
+
+// retryWithFreshCredentials runs fetch and, if it failed because the
+// credentials expired, reloads them and runs it once more. A nil creds
+// runs fetch just once.
+func retryWithFreshCredentials(ctx context.Context, logger *log.Logger, creds *refreshableCredentials, fetch func() error) error {
+	err := fetch()
+	if creds == nil || !isExpiredCredentials(err) || ctx.Err() != nil {
+		return err
+	}
+	if rerr := creds.refresh(ctx, logger); rerr != nil {
+		logger.Printf("Failed to reload expired AWS credentials: %v", rerr)
+		return err
+	}
+	return fetch()
+}
+
+// isExpiredCredentials reports whether err is S3 rejecting a request
+// because its credentials have expired.
+func isExpiredCredentials(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "ExpiredToken", "ExpiredTokenException", "TokenRefreshRequired":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/smithy-go"
+)
+
+func TestRetryWithFreshCredentialsAfterExpiredToken(t *testing.T) {
+	reloads := 0
+	creds := newRefreshableCredentials(credentials.NewStaticCredentialsProvider("OLD", "SECRET", ""), func(context.Context) (aws.CredentialsProvider, error) {
+		reloads++
+		return credentials.NewStaticCredentialsProvider(fmt.Sprintf("NEW%d", reloads), "SECRET", ""), nil
+	})
+	ctx := context.Background()
+
+	var used []string
+	fetch := func() error {
+		c, err := creds.cache.Retrieve(ctx)
+		if err != nil {
+			return err
+		}
+		used = append(used, c.AccessKeyID)
+		if c.AccessKeyID == "OLD" {
+			return &smithy.GenericAPIError{Code: "ExpiredToken", Message: "The provided token has expired."}
+		}
+		return nil
+	}
+	if err := retryWithFreshCredentials(ctx, discardLogger(), creds, fetch); err != nil {
+		t.Fatalf("call failed after refreshing: %v", err)
+	}
+	if reloads != 1 {
+		t.Errorf("credentials reloaded %d times, want once", reloads)
+	}
+	if len(used) != 2 || used[0] != "OLD" || used[1] != "NEW1" {
+		t.Errorf("calls used credentials %v, want [OLD NEW1]", used)
+	}
+
+	// Another download that hit the same expiry just after is retried with
+	// what was already loaded.
+	if err := creds.refresh(ctx, discardLogger()); err != nil {
+		t.Fatal(err)
+	}
+	if reloads != 1 {
+		t.Errorf("credentials reloaded again within %s", credentialRefreshInterval)
+	}
+}
+
+func TestRetryWithFreshCredentialsOtherErrors(t *testing.T) {
+	reloads := 0
+	creds := newRefreshableCredentials(credentials.NewStaticCredentialsProvider("OLD", "SECRET", ""), func(context.Context) (aws.CredentialsProvider, error) {
+		reloads++
+		return credentials.NewStaticCredentialsProvider("NEW", "SECRET", ""), nil
+	})
+	calls := 0
+	err := retryWithFreshCredentials(context.Background(), discardLogger(), creds, func() error {
+		calls++
+		return &smithy.GenericAPIError{Code: "AccessDenied"}
+	})
+	if err == nil || calls != 1 || reloads != 0 {
+		t.Errorf("AccessDenied: err %v after %d calls and %d reloads, want it returned at once", err, calls, reloads)
+	}
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// decompressOptions controls decompressGzipFiles.
+type decompressOptions struct {
+	// force decompresses even when the output already exists and is newer
+	// than the .gz it would be produced from.
+	force bool
+	// verbose logs files skipped because their output is up to date.
+	verbose bool
+	// pretty re-indents every JSON value in the output, one record at a time.
+	pretty bool
+	// followSymlinks decompresses .gz symlinks through to their target.
+	// Symlinks are never removed afterwards, and neither are their targets.
+	followSymlinks bool
+	// checksums, when set, receives the SHA-256 of every output file,
+	// hashed as it is written.
+	checksums *checksumWriter
+	// preserveMtime gives each output the modification time of its .gz.
+	preserveMtime bool
+	// forceGzip also decompresses files that start with the gzip magic
+	// bytes but lack matchSuffix. Those without a .gz suffix are replaced
+	// in place by their decompressed content.
+	forceGzip bool
+	// outDir, when set, receives the decompressed output instead of the
+	// directory of each .gz, mirroring its path below srcDir, and the .gz
+	// files are kept.
+	outDir string
+	srcDir string
+	// maxErrors, when positive, aborts decompression once more than that
+	// many files have failed; see errTooManyDecompressErrors.
+	maxErrors int
+	// memLimit, when positive, bounds the estimated decompressed bytes that
+	// decompressPool workers handle at once.
+	memLimit int64
+	// syncOutput fsyncs every output before its .gz is removed, so the
+	// source is only gone once its decompressed copy is on disk.
+	syncOutput bool
+	// diskLimit, when positive, bounds the estimated disk space that
+	// decompressPool workers hold at once: each file's .gz plus its output,
+	// which both exist until the .gz is removed.
+	diskLimit int64
+	// suffix, when set, replaces the extension of every output file, such
+	// as .json in x.json.gz; see decompressedName.
+	suffix string
+	// splitRecords, when positive, writes the output as chunk files of at
+	// most that many NDJSON records each; see splitRecords.
+	splitRecords int
+	// transform, when set, pipes the decompressed content through a
+	// command whose output is written instead.
+	transform *transformCommand
+	// lenient copies files that aren't gzip data at all but look like
+	// text through unchanged, with a warning, instead of failing them; see
+	// openContent.
+	lenient bool
+	// outputGzip writes every output gzip-compressed at gzipLevel, named
+	// with .gz added; see newOutputGzip.
+	outputGzip bool
+	gzipLevel  int
+}
+
+// outputName is the name of the file the content of a .gz whose
+// decompressed output is outputPath is written to.
+func (o decompressOptions) outputName(outputPath string) string {
+	if o.outputGzip {
+		return outputPath + ".gz"
+	}
+	return outputPath
+}
+
+// newOutputGzip returns a gzip writer for -output-gzip at level, whose
+// header comment marks the file as written by it, so a later run can tell
+// it from a download that is still to be recompressed.
+func newOutputGzip(w io.Writer, level int) (*gzip.Writer, error) {
+	gz, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	gz.Comment = outputGzipComment(level)
+	return gz, nil
+}
+
+func outputGzipComment(level int) string {
+	return fmt.Sprintf("s3downloader -output-gzip -gzip-level %d", level)
+}
+
+// errTooManyDecompressErrors ends decompression once opts.maxErrors is
+// exceeded. That many failures usually point at a problem upstream, such as
+// truncated uploads or objects that aren't gzip at all, rather than at
+// isolated corrupt files, so the rest isn't worth trying.
+var errTooManyDecompressErrors = errors.New("too many files failed to decompress")
+
+// tooManyErrors returns the error that aborts decompression after failed
+// files, or nil while they are within opts.maxErrors.
+func (o decompressOptions) tooManyErrors(failed int) error {
+	if o.maxErrors <= 0 || failed <= o.maxErrors {
+		return nil
+	}
+	return fmt.Errorf("%w: %d failed, more than -max-decompress-errors %d; stopped decompressing, check the source objects for truncation or the wrong format", errTooManyDecompressErrors, failed, o.maxErrors)
+}
+
+// decompressGzipFiles decompresses every matching .gz file under rootDir
+// next to itself and removes the original. A file that fails doesn't stop
+// the walk unless opts.maxErrors is exceeded; every failure is logged and
+// returned joined together.
+func decompressGzipFiles(logger *log.Logger, rootDir string, opts decompressOptions) error {
+	var errs []error
+	var abort error
+	walkErr := filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
+		// Files can vanish once their directory has been read, such as
+		// stale chunks removed by -split-records.
+		if errors.Is(err, fs.ErrNotExist) && path != rootDir {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || !opts.wants(path) {
+			return nil
+		}
+
+		if err := decompressFile(logger, path, info, opts); err != nil {
+			logger.Printf("Failed to decompress %s: %v", path, err)
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			if abort = opts.tooManyErrors(len(errs)); abort != nil {
+				logger.Print(abort)
+				return filepath.SkipAll
+			}
+		}
+		return nil
+	})
+	return errors.Join(append([]error{abort, walkErr}, errs...)...)
+}
+
+// wants reports whether path is to be decompressed: it ends in matchSuffix,
+// or with forceGzip, it holds gzip data whatever its name.
+func (o decompressOptions) wants(path string) bool {
+	return strings.HasSuffix(path, matchSuffix) || o.forceGzip && isGzip(path)
+}
+
+// isGzip reports whether the file at path starts with the gzip magic bytes.
+func isGzip(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	var magic [2]byte
+	_, err = io.ReadFull(f, magic[:])
+	return err == nil && magic == [2]byte{0x1f, 0x8b}
+}
+
+// decompressedName returns the name the decompressed content of path gets:
+// path minus its .gz suffix and, when suffix is set, with the extension left
+// after that replaced by suffix (or suffix added if there is none).
+func decompressedName(path, suffix string) string {
+	name := strings.TrimSuffix(path, ".gz")
+	if suffix == "" {
+		return name
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name)) + suffix
+}
+
+// outputPath returns where the decompressed content of path goes: next to
+// it under its decompressedName, or the same path below opts.outDir.
+func (o decompressOptions) outputPath(path string) (string, error) {
+	if o.outDir == "" {
+		return decompressedName(path, o.suffix), nil
+	}
+	rel, err := filepath.Rel(o.srcDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not below %s", path, o.srcDir)
+	}
+	return filepath.Join(o.outDir, decompressedName(rel, o.suffix)), nil
+}
+
+// outputFor is outputPath, creating the output's directory below
+// opts.outDir.
+func (o decompressOptions) outputFor(path string) (string, error) {
+	out, err := o.outputPath(path)
+	if err != nil || o.outDir == "" {
+		return out, err
+	}
+	if err := os.MkdirAll(filepath.Dir(out), os.ModePerm); err != nil {
+		return "", fmt.Errorf("create output directory: %w", err)
+	}
+	return out, nil
+}
+
+// finishedOutput returns the file that exists once content decompressed
+// to decompressedPath has been written: the output itself, or its first
+// chunk with -split-records.
+func (o decompressOptions) finishedOutput(decompressedPath string) string {
+	if o.splitRecords > 0 {
+		return o.outputName(chunkPath(decompressedPath, 0))
+	}
+	return o.outputName(decompressedPath)
+}
+
+// decompressFile writes the decompressed content of path next to it, minus
+// the .gz suffix, then removes path. A path without the suffix, which only
+// -force-gzip selects, is replaced by its decompressed content instead.
+// With opts.outDir the output goes there and path is kept. With
+// opts.outputGzip the output is recompressed, and when that gives it path's
+// own name, it replaces path the same way.
+// info is path's Lstat FileInfo, so symlinks can be told apart: they are
+// skipped unless opts.followSymlinks, and even then left in place.
+func decompressFile(logger *log.Logger, path string, info os.FileInfo, opts decompressOptions) error {
+	decompressedPath, err := opts.outputFor(path)
+	if err != nil {
+		return err
+	}
+	outputPath := opts.outputName(decompressedPath)
+	inPlace := outputPath == path
+	verb := "Decompressed"
+	if opts.outputGzip {
+		verb = "Recompressed"
+	}
+
+	isLink := info.Mode()&os.ModeSymlink != 0
+	if isLink && inPlace {
+		// Replacing the link would silently turn it into a regular file.
+		logger.Printf("Skipping symlink %s: its output would replace it in place", path)
+		return nil
+	}
+	if isLink {
+		if !opts.followSymlinks {
+			if opts.verbose {
+				logger.Printf("Skipping symlink %s", path)
+			}
+			return nil
+		}
+		target, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("follow symlink: %w", err)
+		}
+		if !target.Mode().IsRegular() {
+			return fmt.Errorf("symlink target is not a regular file")
+		}
+		info = target
+	}
+
+	if !opts.force && !inPlace {
+		upToDate := opts.finishedOutput(decompressedPath)
+		if out, err := os.Stat(upToDate); err == nil && !out.ModTime().Before(info.ModTime()) {
+			if opts.verbose {
+				logger.Printf("Skipping %s: %s is already up to date", path, upToDate)
+			}
+			// Outputs only get their name once complete, so this one can
+			// stand in for path, which is removed as after decompressing.
+			if !isLink && opts.outDir == "" {
+				if err := os.Remove(path); err != nil {
+					logger.Printf("Warning: Failed to remove original file %s: %v", path, err)
+				}
+			}
+			return nil
+		}
+	}
+
+	gzFile, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer gzFile.Close()
+
+	gzReader, err := openContent(logger, path, gzFile, opts.lenient)
+	if err != nil {
+		return err
+	}
+	// Output of an earlier -output-gzip run, such as a chunk or a file
+	// recompressed in place, is matched as a download again.
+	if gz, ok := gzReader.(*gzip.Reader); ok && opts.outputGzip && !opts.force && gz.Comment == outputGzipComment(opts.gzipLevel) {
+		gzReader.Close()
+		if opts.verbose {
+			logger.Printf("Skipping %s: already recompressed", path)
+		}
+		return nil
+	}
+
+	if opts.splitRecords > 0 {
+		chunks, err := splitRecords(gzReader, decompressedPath, opts)
+		if err != nil {
+			return err
+		}
+		if opts.preserveMtime {
+			for _, chunk := range chunks {
+				if err := os.Chtimes(chunk, info.ModTime(), info.ModTime()); err != nil {
+					logger.Printf("Warning: Failed to set the modification time of %s: %v", chunk, err)
+				}
+			}
+		}
+		logger.Printf("%s %s into %d chunk(s) of up to %d records: %s", verb, path, len(chunks), opts.splitRecords, strings.Join(chunks, ", "))
+
+		// The chunks replace path even when it had no .gz suffix.
+		if isLink || opts.outDir != "" {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			logger.Printf("Warning: Failed to remove original file %s: %v", path, err)
+		}
+		return nil
+	}
+
+	// The output goes to a temporary file that is renamed into place once
+	// complete, replacing path when in place, so an interrupted run never
+	// leaves a truncated output that a later one takes as up to date.
+	outFile, err := os.CreateTemp(filepath.Dir(outputPath), filepath.Base(outputPath)+".*.tmp")
+	if err != nil {
+		gzReader.Close()
+		return fmt.Errorf("create output file: %w", err)
+	}
+	writePath := outFile.Name()
+
+	var w io.Writer = outFile
+	var sum hash.Hash
+	if opts.checksums != nil {
+		sum = sha256.New()
+		w = io.MultiWriter(outFile, sum)
+	}
+	var gzWriter *gzip.Writer
+	if opts.outputGzip {
+		if gzWriter, err = newOutputGzip(w, opts.gzipLevel); err != nil {
+			gzReader.Close()
+			outFile.Close()
+			os.Remove(writePath)
+			return fmt.Errorf("create gzip writer: %w", err)
+		}
+		w = gzWriter
+	}
+	if opts.pretty {
+		err = prettyJSON(w, gzReader)
+	} else if opts.transform != nil {
+		err = opts.transform.run(path, w, gzReader)
+	} else {
+		_, err = io.Copy(w, gzReader)
+	}
+	if err != nil {
+		err = fmt.Errorf("write %s: %w", outputPath, err)
+	}
+	// A corrupt CRC32 or length trailer, or a failed final write, only
+	// shows up here, so both closes count towards the result.
+	if cerr := gzReader.Close(); cerr != nil && err == nil {
+		err = fmt.Errorf("close gzip stream: %w", cerr)
+	}
+	if gzWriter != nil {
+		if cerr := gzWriter.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("write %s: %w", outputPath, cerr)
+		}
+	}
+	if opts.syncOutput && err == nil {
+		if serr := outFile.Sync(); serr != nil {
+			err = fmt.Errorf("sync %s: %w", outputPath, serr)
+		}
+	}
+	if cerr := outFile.Close(); cerr != nil && err == nil {
+		err = fmt.Errorf("close %s: %w", outputPath, cerr)
+	}
+	if err == nil {
+		if rerr := os.Rename(writePath, outputPath); rerr != nil {
+			err = fmt.Errorf("rename %s: %w", outputPath, rerr)
+		}
+	}
+	if err != nil {
+		// Don't leave partial or corrupt output behind looking complete.
+		if rerr := os.Remove(writePath); rerr != nil {
+			logger.Printf("Warning: Failed to remove incomplete output %s: %v", writePath, rerr)
+		}
+		return err
+	}
+	if sum != nil {
+		opts.checksums.add(outputPath, sum.Sum(nil))
+	}
+	if opts.preserveMtime {
+		if err := os.Chtimes(outputPath, info.ModTime(), info.ModTime()); err != nil {
+			logger.Printf("Warning: Failed to set the modification time of %s: %v", outputPath, err)
+		}
+	}
+
+	if inPlace {
+		logger.Printf("%s %s in place", verb, path)
+		return nil
+	}
+	logger.Printf("%s %s to %s", verb, path, outputPath)
+
+	if isLink || opts.outDir != "" {
+		return nil
+	}
+	if err := os.Remove(path); err != nil {
+		logger.Printf("Warning: Failed to remove original file %s: %v", path, err)
+	}
+	return nil
+}
+
+// openContent returns a reader of the decompressed content of f, the file
+// at path. When f isn't gzip data and lenient is set, a file that looks like
+// text, such as JSON uploaded as .json.gz without being compressed, is read
+// as it is instead, with a warning.
+func openContent(logger *log.Logger, path string, f *os.File, lenient bool) (io.ReadCloser, error) {
+	gz, err := gzip.NewReader(f)
+	if err == nil {
+		return gz, nil
+	}
+	if !lenient {
+		return nil, fmt.Errorf("create gzip reader: %w", err)
+	}
+	head := make([]byte, textSniffSize)
+	n, rerr := f.ReadAt(head, 0)
+	if rerr != nil && rerr != io.EOF {
+		return nil, fmt.Errorf("create gzip reader: %w", err)
+	}
+	head = head[:n]
+	if bytes.HasPrefix(head, []byte{0x1f, 0x8b}) || !looksLikeText(head, n < textSniffSize) {
+		return nil, fmt.Errorf("create gzip reader: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	logger.Printf("Warning: %s is not gzip data but looks like text; copying it through unchanged", path)
+	return io.NopCloser(f), nil
+}
+
+// textSniffSize is how much of a file looksLikeText is shown.
+const textSniffSize = 4 << 10
+
+// looksLikeText reports whether head, the start of a file or all of it when
+// whole, is non-empty UTF-8 text without control characters other than
+// whitespace. A multi-byte character cut off at the end of a partial head
+// doesn't count against it.
+func looksLikeText(head []byte, whole bool) bool {
+	if len(head) == 0 {
+		return false
+	}
+	for len(head) > 0 {
+		r, size := utf8.DecodeRune(head)
+		if r == utf8.RuneError && size <= 1 {
+			return !whole && !utf8.FullRune(head)
+		}
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' && r != '\f' || r == 0x7f {
+			return false
+		}
+		head = head[size:]
+	}
+	return true
+}
+
+// decompressPool decompresses files as they are handed to it, on a fixed
+// number of workers, so decompression overlaps with downloads still in
+// progress instead of waiting for all of them.
+type decompressPool struct {
+	jobs chan string
+	opts decompressOptions
+	wg   sync.WaitGroup
+
+	mu    sync.Mutex
+	errs  []error
+	abort error
+	// stopped drops the queued work once the run ends without
+	// decompressing; see stop.
+	stopped bool
+	closed  sync.Once
+}
+
+func startDecompressPool(logger *log.Logger, workers int, opts decompressOptions) *decompressPool {
+	p := &decompressPool{jobs: make(chan string, workers), opts: opts}
+	var budget, disk *memBudget
+	if opts.memLimit > 0 {
+		budget = newMemBudget(opts.memLimit)
+	}
+	if opts.diskLimit > 0 {
+		disk = newMemBudget(opts.diskLimit)
+	}
+	for range workers {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for path := range p.jobs {
+				// Once aborted, drain the queue so downloads still
+				// finishing don't block on it.
+				p.mu.Lock()
+				aborted := p.abort != nil || p.stopped
+				p.mu.Unlock()
+				if aborted {
+					continue
+				}
+				info, err := os.Lstat(path)
+				if err == nil {
+					var cost, space int64
+					if budget != nil || disk != nil {
+						cost = decompressedSize(path, info.Size())
+						space = cost + info.Size()
+					}
+					if budget != nil {
+						budget.acquire(cost)
+					}
+					if disk != nil {
+						disk.acquire(space)
+					}
+					err = decompressFile(logger, path, info, opts)
+					if disk != nil {
+						disk.release(space)
+					}
+					if budget != nil {
+						budget.release(cost)
+					}
+				}
+				if err != nil {
+					logger.Printf("Failed to decompress %s: %v", path, err)
+					p.mu.Lock()
+					p.errs = append(p.errs, fmt.Errorf("%s: %w", path, err))
+					if p.abort == nil {
+						if p.abort = opts.tooManyErrors(len(p.errs)); p.abort != nil {
+							logger.Print(p.abort)
+						}
+					}
+					p.mu.Unlock()
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues a finished download for decompression. It has the shape of
+// downloadOptions.onComplete and ignores failed or non-matching downloads.
+func (p *decompressPool) submit(_, path string, err error) {
+	if err == nil && p.opts.wants(path) {
+		p.jobs <- path
+	}
+}
+
+// wait stops accepting work, lets the queue drain and returns every failure.
+func (p *decompressPool) wait() error {
+	p.closed.Do(func() { close(p.jobs) })
+	p.wg.Wait()
+	return errors.Join(append([]error{p.abort}, p.errs...)...)
+}
+
+// stop drops whatever is still queued and waits for the files being
+// decompressed, for a run that ends early, so none is left half-written
+// as the process exits. It does nothing once wait has returned.
+func (p *decompressPool) stop() {
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+	p.wait()
+}
+
+// memBudget admits work while the estimated bytes in flight stay within a
+// limit. Work larger than the whole limit is still admitted once nothing
+// else is in flight, so it can't wait forever.
+type memBudget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+}
+
+func newMemBudget(limit int64) *memBudget {
+	b := &memBudget{limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *memBudget) acquire(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.used > 0 && b.used+n > b.limit {
+		b.cond.Wait()
+	}
+	b.used += n
+}
+
+func (b *memBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	b.cond.Broadcast()
+}
+
+// decompressedSize estimates the decompressed size of the gzip file at path
+// from the ISIZE field of its trailer: the input length modulo 2^32. That
+// wraps for members over 4 GiB and only covers the last member, so the
+// compressed size is used whenever it is larger.
+func decompressedSize(path string, compressed int64) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return compressed
+	}
+	defer f.Close()
+	var trailer [4]byte
+	if compressed < int64(len(trailer)) {
+		return compressed
+	}
+	if _, err := f.ReadAt(trailer[:], compressed-int64(len(trailer))); err != nil {
+		return compressed
+	}
+	return max(int64(binary.LittleEndian.Uint32(trailer[:])), compressed)
+}
+
+// prettyJSON re-emits each JSON value from r indented, followed by a newline.
+// Values are decoded one at a time, so NDJSON keeps one (now multi-line)
+// record after another and memory is bounded by the largest record.
+func prettyJSON(w io.Writer, r io.Reader) error {
+	dec := json.NewDecoder(r)
+	bw := bufio.NewWriter(w)
+	var buf bytes.Buffer
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("parse JSON: %w", err)
+		}
+		buf.Reset()
+		if err := json.Indent(&buf, raw, "", "  "); err != nil {
+			return err
+		}
+		buf.WriteByte('\n')
+		if _, err := bw.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
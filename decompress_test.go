@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeGzip writes content to path, gzip-compressed.
+func writeGzip(t *testing.T, path, content string) {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(content))
+	gz.Close()
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecompressGzipFilesReportsEveryCorruptFile(t *testing.T) {
+	dir := t.TempDir()
+	good := map[string]string{
+		filepath.Join(dir, "a.json.gz"):        "{\"a\":1}\n",
+		filepath.Join(dir, "sub", "b.json.gz"): "{\"b\":2}\n",
+	}
+	os.MkdirAll(filepath.Join(dir, "sub"), 0o755)
+	for path, content := range good {
+		writeGzip(t, path, content)
+	}
+	corrupt := []string{filepath.Join(dir, "bad1.json.gz"), filepath.Join(dir, "sub", "bad2.json.gz")}
+	for _, path := range corrupt {
+		os.WriteFile(path, []byte("not gzip at all"), 0o644)
+	}
+
+	err := decompressGzipFiles(discardLogger(), dir, decompressOptions{})
+	if err == nil {
+		t.Fatal("corrupt files reported no error")
+	}
+	for _, path := range corrupt {
+		if !strings.Contains(err.Error(), path) {
+			t.Errorf("error doesn't mention %s: %v", path, err)
+		}
+		if _, serr := os.Stat(path); serr != nil {
+			t.Errorf("corrupt %s was removed: %v", path, serr)
+		}
+	}
+	var joined interface{ Unwrap() []error }
+	if !errors.As(err, &joined) {
+		t.Fatalf("error is not joined: %v", err)
+	}
+	var failures int
+	for _, e := range joined.Unwrap() {
+		if e != nil {
+			failures++
+		}
+	}
+	if failures != len(corrupt) {
+		t.Errorf("joined %d errors, want %d: %v", failures, len(corrupt), err)
+	}
+
+	for path, content := range good {
+		out := strings.TrimSuffix(path, ".gz")
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Errorf("good file not decompressed: %v", err)
+			continue
+		}
+		if string(data) != content {
+			t.Errorf("%s = %q, want %q", out, data, content)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was kept after decompressing", path)
+		}
+	}
+}
+
+func TestDecompressFileCorruptTrailer(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "x.json.gz")
+	writeGzip(t, path, strings.Repeat("{\"n\":1}\n", 1000))
+	data, _ := os.ReadFile(path)
+	// The trailer is the CRC-32 and the length, 4 bytes each.
+	data[len(data)-8] ^= 0xff
+	data[len(data)-7] ^= 0xff
+	os.WriteFile(path, data, 0o644)
+
+	info, _ := os.Lstat(path)
+	if err := decompressFile(discardLogger(), path, info, decompressOptions{}); err == nil {
+		t.Fatal("corrupt trailer decompressed without an error")
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if e.Name() != "x.json.gz" {
+			t.Errorf("%s left behind", e.Name())
+		}
+	}
+	if len(entries) == 0 {
+		t.Error("the .gz was removed")
+	}
+}
+
+func TestDecompressPoolStopLeavesNoPartialOutput(t *testing.T) {
+	dir := t.TempDir()
+	content := strings.Repeat("{\"n\":1}\n", 1<<16)
+	var paths []string
+	for i := range 8 {
+		path := filepath.Join(dir, fmt.Sprintf("f%d.json.gz", i))
+		writeGzip(t, path, content)
+		paths = append(paths, path)
+	}
+
+	out := t.TempDir()
+	pool := startDecompressPool(discardLogger(), 2, decompressOptions{srcDir: dir, outDir: out})
+	for _, path := range paths {
+		pool.submit("", path, nil)
+	}
+	pool.stop()
+
+	entries, _ := os.ReadDir(out)
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(out, e.Name()))
+		if err != nil || !strings.HasSuffix(e.Name(), ".json") || string(data) != content {
+			t.Errorf("%s left behind after stop (%d bytes, %v)", e.Name(), len(data), err)
+		}
+	}
+	if err := pool.wait(); err != nil {
+		t.Errorf("wait after stop: %v", err)
+	}
+}
+
+func TestDecompressFileUpToDateRemovesSource(t *testing.T) {
+	for _, separate := range []bool{false, true} {
+		t.Run(fmt.Sprintf("outDir=%t", separate), func(t *testing.T) {
+			dir := t.TempDir()
+			opts := decompressOptions{srcDir: dir}
+			out := filepath.Join(dir, "x.json")
+			if separate {
+				opts.outDir = t.TempDir()
+				out = filepath.Join(opts.outDir, "x.json")
+			}
+			path := filepath.Join(dir, "x.json.gz")
+			writeGzip(t, path, "{\"new\":1}\n")
+			os.WriteFile(out, []byte("{\"old\":1}\n"), 0o644)
+			// As -preserve-mtime leaves a re-download and its earlier output.
+			mtime := time.Now().Add(-time.Hour)
+			os.Chtimes(path, mtime, mtime)
+			os.Chtimes(out, mtime, mtime)
+
+			info, _ := os.Lstat(path)
+			if err := decompressFile(discardLogger(), path, info, opts); err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := os.ReadFile(out); string(data) != "{\"old\":1}\n" {
+				t.Errorf("up-to-date output rewritten: %q", data)
+			}
+			_, err := os.Stat(path)
+			if kept := err == nil; kept != separate {
+				t.Errorf("source kept = %t, want %t", kept, separate)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// errDuplicate is the outcome of a download whose content matched an earlier
+// one under -dedupe. The file has been removed; it is not a failure.
+var errDuplicate = errors.New("duplicate content")
+
+// dedupeIndex remembers the SHA-256 of downloaded files so later copies of
+// the same bytes can be dropped. To keep memory bounded it holds at most
+// capacity hashes, forgetting the oldest first; a duplicate of a forgotten
+// hash is simply kept, so the bound can only cost disk space, never data.
+type dedupeIndex struct {
+	mu       sync.Mutex
+	capacity int
+	seen     map[[sha256.Size]byte]string // hash -> first key with it
+	order    [][sha256.Size]byte          // insertion ring for eviction
+	head     int
+
+	log io.Writer // duplicate->original mapping, may be nil
+}
+
+func newDedupeIndex(capacity int, log io.Writer) *dedupeIndex {
+	return &dedupeIndex{
+		capacity: capacity,
+		seen:     make(map[[sha256.Size]byte]string),
+		log:      log,
+	}
+}
+
+// check hashes the file at path and returns the key it duplicates, or "" if
+// its content is new and has now been recorded under key.
+func (d *dedupeIndex) check(key, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if original, ok := d.seen[sum]; ok {
+		if d.log != nil {
+			fmt.Fprintf(d.log, "%s\t%s\n", key, original)
+		}
+		return original, nil
+	}
+
+	if len(d.order) < d.capacity {
+		d.order = append(d.order, sum)
+	} else {
+		delete(d.seen, d.order[d.head])
+		d.order[d.head] = sum
+		d.head = (d.head + 1) % d.capacity
+	}
+	d.seen[sum] = key
+	return "", nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// objectDeleter removes each object from S3 once it has been downloaded,
+// for -delete-after. Objects that S3 Object Lock keeps from being deleted
+// are skipped with a warning rather than counted as failures.
+type objectDeleter struct {
+	ctx    context.Context
+	logger *log.Logger
+	svc    *s3.Client
+	bucket string
+
+	mu      sync.Mutex
+	deleted int
+	locked  int
+	errs    []error
+}
+
+func newObjectDeleter(ctx context.Context, logger *log.Logger, svc *s3.Client, bucket string) *objectDeleter {
+	return &objectDeleter{ctx: ctx, logger: logger, svc: svc, bucket: bucket}
+}
+
+// hook has the shape of downloadOptions.onComplete and deletes key when its
+// download succeeded. Duplicates removed by -dedupe and failed downloads
+// are left alone.
+func (d *objectDeleter) hook(key, _ string, err error) {
+	if err != nil || d.ctx.Err() != nil {
+		return
+	}
+	_, err = d.svc.DeleteObject(d.ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil && d.isLocked(key, err) {
+		d.logger.Printf("Warning: not deleting %s: it is under Object Lock retention or legal hold", key)
+		d.mu.Lock()
+		d.locked++
+		d.mu.Unlock()
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		d.logger.Printf("Failed to delete %s: %v", key, err)
+		d.errs = append(d.errs, fmt.Errorf("delete %s: %w", key, err))
+		return
+	}
+	d.deleted++
+}
+
+// isLocked reports whether a failed delete of key was refused because of
+// Object Lock. S3 answers AccessDenied either way, so unless the message
+// says so, the object's retention and legal hold are looked up.
+func (d *objectDeleter) isLocked(key string, err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "AccessDenied" {
+		return false
+	}
+	if strings.Contains(strings.ToLower(apiErr.ErrorMessage()), "object lock") {
+		return true
+	}
+
+	retention, err := d.svc.GetObjectRetention(d.ctx, &s3.GetObjectRetentionInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil && retention.Retention != nil && aws.ToTime(retention.Retention.RetainUntilDate).After(time.Now()) {
+		return true
+	}
+	hold, err := d.svc.GetObjectLegalHold(d.ctx, &s3.GetObjectLegalHoldInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(key),
+	})
+	return err == nil && hold.LegalHold != nil && hold.LegalHold.Status == types.ObjectLockLegalHoldStatusOn
+}
+
+// finish logs how many objects were deleted and skipped, records them in
+// summary if set, and returns every failed delete.
+func (d *objectDeleter) finish(summary *runSummary) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.logger.Printf("Deleted %d downloaded object(s) from s3://%s", d.deleted, d.bucket)
+	if d.locked > 0 {
+		d.logger.Printf("Skipped deleting %d object(s) held by Object Lock", d.locked)
+	}
+	if summary != nil {
+		summary.addDeletions(d.deleted, d.locked)
+	}
+	return errors.Join(d.errs...)
+}
@@ -0,0 +1,726 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Policies for -on-existing, applied when a download target already exists.
+const (
+	onExistingSkip      = "skip"
+	onExistingOverwrite = "overwrite"
+	onExistingError     = "error"
+)
+
+// downloadOptions controls how downloadFiles writes objects locally.
+type downloadOptions struct {
+	onExisting string
+	// minConcurrency and maxConcurrency bound the adaptive download limit.
+	// With throttleOnError, throttling may push it below minConcurrency,
+	// down to a single download, before it climbs back. limiter, if set, is
+	// used instead of a new limiter with those bounds.
+	minConcurrency  int
+	maxConcurrency  int
+	throttleOnError bool
+	limiter         *adaptiveLimiter
+	// onComplete, if set, is called once per key after its file is closed,
+	// with a nil error when the file is available at path. Calls come from
+	// the download workers concurrently.
+	onComplete func(key, path string, err error)
+	// rangeBytes, when positive, fetches only the first rangeBytes bytes of
+	// each object with a ranged GetObject instead of the transfer manager.
+	rangeBytes int64
+	// template, when set, maps keys to local paths instead of mirroring them.
+	template *outputTemplate
+	// dedupe, when set, drops downloads whose content was already seen.
+	dedupe *dedupeIndex
+	// tempDir, when set, stages downloads there before moving them into
+	// localDir.
+	tempDir string
+	// minThroughput, when positive, cancels a download that writes fewer
+	// than this many bytes per second over a whole stallWindow.
+	minThroughput int64
+	stallWindow   time.Duration
+	// retries is how many more times a download that failed in a retryable
+	// way, such as a stall, is attempted, waiting on backoff in between.
+	retries int
+	backoff backoff
+	// retryBudget, when set, also has to allow each retry; see retryBudget.
+	retryBudget *retryBudget
+	// failFast stops every remaining download after the first failure.
+	failFast bool
+	// ifModifiedSince makes the GetObject for a file that exists locally
+	// conditional on the object being newer than that file.
+	ifModifiedSince bool
+	// decompressed is how downloads are decompressed afterwards, for
+	// finding a file's local copy once it has been; see existingCopy.
+	decompressed decompressOptions
+	// breakerThreshold, when positive, trips a circuit breaker after that
+	// many consecutive failed downloads; see circuitBreaker.
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	// toMemory, when set, downloads each object into memory and passes its
+	// content to toMemory instead of writing anything under localDir;
+	// onComplete then gets an empty path. Calls come from the download
+	// workers concurrently. There is no flag for it: it is for callers that
+	// build options themselves.
+	toMemory func(key string, data []byte)
+	// upload, when set, streams each object on to another bucket instead
+	// of writing it locally; onComplete then gets an empty path.
+	upload *passthrough
+	// compactLogs replaces the line per downloaded file with a running total.
+	compactLogs bool
+	// caseCollisions is the -case-collisions policy for keys whose local
+	// paths differ only by case on a case-insensitive filesystem.
+	caseCollisions string
+	// credentials, when set, is reloaded when a download fails because the
+	// credentials expired, and the download tried once more.
+	credentials *refreshableCredentials
+	// versions, when set, maps keys to the version to fetch instead of the
+	// current one.
+	versions map[string]string
+	// modTimes, when set, holds each key's LastModified; downloaded files
+	// get it as their modification time.
+	modTimes map[string]time.Time
+	// requireChecksum verifies every downloaded file against the checksum
+	// S3 holds for it, and fails objects S3 holds no usable checksum for;
+	// see objectChecksum.
+	requireChecksum bool
+	// maxPending, when positive, bounds how many keys downloadStream takes
+	// from its channel before their downloads finish, so whatever feeds
+	// the channel waits once that many are in flight. Otherwise it takes
+	// every key as soon as it arrives, and each waits for the limiter on a
+	// goroutine of its own.
+	maxPending int
+}
+
+// writesLocally reports whether downloads land under localDir, rather than
+// in memory or in another bucket, so that the steps around them that look
+// at or write to localDir apply.
+func (o downloadOptions) writesLocally() bool {
+	return o.toMemory == nil && o.upload == nil
+}
+
+// addOnComplete chains fn after any onComplete hook already set.
+func (o *downloadOptions) addOnComplete(fn func(key, path string, err error)) {
+	prev := o.onComplete
+	if prev == nil {
+		o.onComplete = fn
+		return
+	}
+	o.onComplete = func(key, path string, err error) {
+		prev(key, path, err)
+		fn(key, path, err)
+	}
+}
+
+// errFailFast is the cause downloadFiles cancels its work with when
+// failFast is set and a download fails.
+var errFailFast = errors.New("stopped after the first failure (-fail-fast)")
+
+// With compactLogs, downloadFiles logs its running total every
+// compactLogFiles files or compactLogInterval, whichever comes first.
+const (
+	compactLogFiles    = 1000
+	compactLogInterval = 5 * time.Second
+)
+
+// downloadProgress counts finished downloads for compactLogs. total is 0
+// when it isn't known up front.
+type downloadProgress struct {
+	total int
+	done  atomic.Int64
+	bytes atomic.Int64
+
+	mu       sync.Mutex
+	lastLog  time.Time
+	lastDone int64
+}
+
+func newDownloadProgress(total int) *downloadProgress {
+	return &downloadProgress{total: total, lastLog: time.Now()}
+}
+
+// record counts one file of size bytes and logs the totals if enough files
+// or time have passed since the last line.
+func (p *downloadProgress) record(logger *log.Logger, size int64) {
+	done := p.done.Add(1)
+	p.bytes.Add(size)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if done-p.lastDone < compactLogFiles && time.Since(p.lastLog) < compactLogInterval {
+		return
+	}
+	p.log(logger)
+}
+
+// log writes the current totals. The caller holds p.mu.
+func (p *downloadProgress) log(logger *log.Logger) {
+	p.lastLog = time.Now()
+	p.lastDone = p.done.Load()
+	if p.total == 0 {
+		logger.Printf("Downloaded %d files (%s)", p.lastDone, formatBytes(p.bytes.Load()))
+		return
+	}
+	logger.Printf("Downloaded %d/%d files (%s)", p.lastDone, p.total, formatBytes(p.bytes.Load()))
+}
+
+// newLimiter returns a download limiter with the configured bounds.
+func (o *downloadOptions) newLimiter(logger *log.Logger) *adaptiveLimiter {
+	floor := o.minConcurrency
+	if o.throttleOnError {
+		floor = 1
+	}
+	return newAdaptiveLimiter(logger, floor, o.minConcurrency, o.maxConcurrency)
+}
+
+// createMarkedDirs creates the local directory for each folder marker key.
+// The directories mirror the keys even when an output template is in use.
+func createMarkedDirs(logger *log.Logger, localDir string, markers []string) error {
+	for _, marker := range markers {
+		dir, err := targetPath(localDir, marker, nil)
+		if err != nil {
+			logger.Printf("Skipping folder marker %s: %v", marker, err)
+			continue
+		}
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return fmt.Errorf("create directory for folder marker %s: %w", marker, err)
+		}
+	}
+	return nil
+}
+
+// existingTargets returns the local copies, as found by existingCopy, of
+// keys that are already present in localDir. Keys without a valid local
+// path are left to downloadFiles to report.
+func existingTargets(localDir string, keys []string, opts downloadOptions) []string {
+	var existing []string
+	for _, key := range keys {
+		filePath, err := targetPath(localDir, key, opts.template)
+		if err != nil {
+			continue
+		}
+		if localCopy, _ := existingCopy(filePath, opts.decompressed); localCopy != "" {
+			existing = append(existing, localCopy)
+		}
+	}
+	return existing
+}
+
+// downloadFiles fetches every key into localDir, mirroring the key layout,
+// or into memory or another bucket when opts.toMemory or opts.upload is
+// set. Failures are logged as they happen and returned joined together once
+// all workers have finished.
+func downloadFiles(ctx context.Context, logger *log.Logger, svc *s3.Client, bucket, localDir string, keys []string, opts downloadOptions) error {
+	var renamed map[string]string
+	if opts.writesLocally() {
+		renamed = resolveCaseCollisions(logger, localDir, keys, opts.template, opts.caseCollisions)
+	}
+	feed := make(chan string, len(keys))
+	for _, key := range keys {
+		feed <- key
+	}
+	close(feed)
+	return downloadStream(ctx, logger, svc, bucket, localDir, feed, len(keys), renamed, opts)
+}
+
+// downloadStream is downloadFiles for keys that arrive over a channel, such
+// as from a listing still in progress; it returns once keys is closed and
+// every download has finished. total is the number of keys if known, and
+// renamed holds the local paths that replace the usual ones, as from
+// resolveCaseCollisions.
+func downloadStream(ctx context.Context, logger *log.Logger, svc *s3.Client, bucket, localDir string, keys <-chan string, total int, renamed map[string]string, opts downloadOptions) error {
+	downloader := manager.NewDownloader(svc)
+
+	var wg sync.WaitGroup
+	limiter := opts.limiter
+	if limiter == nil {
+		limiter = opts.newLimiter(logger)
+	}
+	inFlight := newPathSet()
+	var progress *downloadProgress
+	if opts.compactLogs {
+		progress = newDownloadProgress(total)
+	}
+	var breaker *circuitBreaker
+	if opts.breakerThreshold > 0 {
+		breaker = newCircuitBreaker(logger, opts.breakerThreshold, opts.breakerCooldown)
+	}
+	// attempt runs fetch once the breaker allows it, with a second go if
+	// the credentials expired, and reports the outcome back to the breaker.
+	attempt := func(fetch func() error) error {
+		if breaker == nil {
+			return retryWithFreshCredentials(ctx, logger, opts.credentials, fetch)
+		}
+		probe, err := breaker.allow(ctx)
+		if err != nil {
+			return err
+		}
+		err = retryWithFreshCredentials(ctx, logger, opts.credentials, fetch)
+		if ctx.Err() == nil {
+			breaker.record(probe, err)
+		}
+		return err
+	}
+
+	// With failFast, the first failure cancels everything still to come.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var errMu sync.Mutex
+	var errs []error
+	fail := func(err error) {
+		errMu.Lock()
+		defer errMu.Unlock()
+		if opts.failFast {
+			if len(errs) == 0 {
+				cancel(errFailFast)
+			} else if errors.Is(context.Cause(ctx), errFailFast) {
+				// Downloads cut short by the cancellation only add noise.
+				return
+			}
+		}
+		errs = append(errs, err)
+	}
+
+	// If the run is interrupted, whatever is still in flight is truncated.
+	// Wait for the workers to close their files, then remove those paths so
+	// only fully downloaded files remain in localDir.
+	defer func() {
+		if ctx.Err() == nil {
+			return
+		}
+		for _, path := range inFlight.list() {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				logger.Printf("Failed to remove partial file %s: %v", path, err)
+			} else {
+				logger.Printf("Removed partial file %s", path)
+			}
+		}
+	}()
+
+	var pending chan struct{}
+	if opts.maxPending > 0 {
+		pending = make(chan struct{}, opts.maxPending)
+	}
+	for key := range keys {
+		if pending != nil {
+			pending <- struct{}{}
+		}
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			if pending != nil {
+				defer func() { <-pending }()
+			}
+
+			// Mirror the S3 key structure locally, unless a template says
+			// otherwise
+			var filePath string
+			var pathErr error
+			if opts.writesLocally() {
+				filePath, pathErr = targetPath(localDir, key, opts.template)
+				if alt, ok := renamed[key]; ok {
+					filePath = alt
+				}
+			}
+
+			// outcome is nil once the file is in place, whether downloaded
+			// or kept by -on-existing=skip.
+			var outcome error
+			if opts.onComplete != nil {
+				defer func() { opts.onComplete(key, filePath, outcome) }()
+			}
+			if pathErr != nil {
+				logger.Printf("Skipping %s: %v", key, pathErr)
+				outcome = pathErr
+				fail(outcome)
+				return
+			}
+
+			limiter.acquire()
+			defer func() { limiter.release(outcome) }()
+
+			if err := ctx.Err(); err != nil {
+				outcome = err
+				return
+			}
+
+			if opts.toMemory != nil {
+				var data []byte
+				err := attempt(func() (err error) {
+					data, err = fetchToMemory(ctx, svc, downloader, bucket, key, opts.rangeBytes)
+					return err
+				})
+				if err != nil {
+					logger.Printf("Failed to download %s: %v", key, err)
+					outcome = fmt.Errorf("download %s: %w", key, err)
+					fail(outcome)
+					return
+				}
+				if progress != nil {
+					progress.record(logger, int64(len(data)))
+				} else {
+					logger.Printf("Downloaded %s into memory (%s)", key, formatBytes(int64(len(data))))
+				}
+				opts.toMemory(key, data)
+				return
+			}
+
+			if opts.upload != nil {
+				var n int64
+				err := attempt(func() (err error) {
+					n, err = opts.upload.copy(ctx, svc, bucket, key, opts.rangeBytes)
+					return err
+				})
+				if err != nil {
+					if !errors.Is(err, errCircuitOpen) {
+						logger.Printf("Failed to copy %s: %v", key, err)
+					}
+					outcome = fmt.Errorf("copy %s: %w", key, err)
+					fail(outcome)
+					return
+				}
+				if progress != nil {
+					progress.record(logger, n)
+				} else {
+					logger.Printf("Copied %s to %s (%s)", key, opts.upload.url(key), formatBytes(n))
+				}
+				return
+			}
+
+			if opts.onExisting == onExistingSkip {
+				if localCopy, info := existingCopy(filePath, opts.decompressed); localCopy != "" {
+					if progress != nil {
+						progress.record(logger, info.Size())
+					} else {
+						logger.Printf("Skipping %s: %s already exists", key, localCopy)
+					}
+					return
+				}
+			}
+			if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+				logger.Printf("Failed to create dir for %s: %v", key, err)
+				outcome = fmt.Errorf("create dir for %s: %w", key, err)
+				fail(outcome)
+				return
+			}
+
+			input := &s3.GetObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(key),
+			}
+			if versionID, ok := opts.versions[key]; ok {
+				input.VersionId = aws.String(versionID)
+			}
+			var localCopy string
+			if opts.ifModifiedSince {
+				var info os.FileInfo
+				if localCopy, info = existingCopy(filePath, opts.decompressed); localCopy != "" {
+					input.IfModifiedSince = aws.Time(info.ModTime())
+				}
+			}
+			err := attempt(func() error {
+				var want expectedChecksum
+				if opts.requireChecksum {
+					var err error
+					if want, err = objectChecksum(ctx, svc, input); err != nil {
+						return err
+					}
+					input.IfMatch = aws.String(want.etag)
+				}
+				for n := 0; ; n++ {
+					err := fetchObject(ctx, svc, downloader, input, filePath, opts, inFlight)
+					if err == nil && opts.requireChecksum {
+						if err = want.verify(filePath); err != nil {
+							os.Remove(filePath)
+						}
+					}
+					if err == nil || !isRetryable(err) || n >= opts.retries || ctx.Err() != nil || !opts.retryBudget.take(logger) {
+						return err
+					}
+					wait := opts.backoff.delay(n)
+					logger.Printf("Retrying %s in %s (attempt %d of %d): %v", key, wait, n+2, opts.retries+1, err)
+					select {
+					case <-time.After(wait):
+					case <-ctx.Done():
+					}
+				}
+			})
+			if localCopy != "" && isNotModified(err) {
+				// The local copy stands in for the download, so hooks see
+				// the file that is actually there.
+				filePath = localCopy
+				if progress != nil {
+					var size int64
+					if info, err := os.Stat(filePath); err == nil {
+						size = info.Size()
+					}
+					progress.record(logger, size)
+				} else {
+					logger.Printf("Skipping %s: unchanged since %s was written", key, filePath)
+				}
+				return
+			}
+			if err != nil {
+				// The breaker already logged why it fails everything left.
+				if !errors.Is(err, errCircuitOpen) {
+					logger.Printf("Failed to download %s: %v", key, err)
+				}
+				outcome = fmt.Errorf("download %s: %w", key, err)
+				fail(outcome)
+			} else if progress != nil {
+				var size int64
+				if info, err := os.Stat(filePath); err == nil {
+					size = info.Size()
+				}
+				progress.record(logger, size)
+			} else {
+				logger.Printf("Downloaded %s to %s", key, filePath)
+			}
+
+			if modTime, ok := opts.modTimes[key]; ok && err == nil && !modTime.IsZero() {
+				if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+					logger.Printf("Failed to set the modification time of %s: %v", filePath, err)
+				}
+			}
+
+			if err == nil && opts.dedupe != nil {
+				original, err := opts.dedupe.check(key, filePath)
+				switch {
+				case err != nil:
+					logger.Printf("Failed to hash %s for dedupe, keeping it: %v", filePath, err)
+				case original != "":
+					logger.Printf("Removing %s: same content as %s", filePath, original)
+					if err := os.Remove(filePath); err != nil {
+						logger.Printf("Failed to remove duplicate %s: %v", filePath, err)
+					}
+					outcome = errDuplicate
+				}
+			}
+		}(key)
+	}
+
+	wg.Wait()
+
+	if progress != nil {
+		progress.mu.Lock()
+		progress.log(logger)
+		progress.mu.Unlock()
+	}
+
+	if errors.Is(context.Cause(ctx), errFailFast) {
+		return fmt.Errorf("%w: %w", errFailFast, errs[0])
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// fetchObject downloads the object described by input to filePath. With
+// opts.tempDir it is written to a .part file there first and moved into
+// place only once complete, so filePath never holds a partial object. A
+// conditional request is staged the same way next to filePath, so the file
+// it is conditional on survives a 304.
+//
+// Paths being written are tracked in inFlight until they are complete. A
+// failed direct download stays tracked, leaving its truncated file for
+// downloadFiles to clean up if the run is interrupted.
+func fetchObject(ctx context.Context, svc *s3.Client, downloader *manager.Downloader, input *s3.GetObjectInput, filePath string, opts downloadOptions, inFlight *pathSet) error {
+	stageDir := opts.tempDir
+	if stageDir == "" && input.IfModifiedSince != nil {
+		stageDir = filepath.Dir(filePath)
+	}
+
+	var file *os.File
+	var err error
+	if stageDir != "" {
+		file, err = os.CreateTemp(stageDir, filepath.Base(filePath)+".*.part")
+	} else {
+		file, err = os.Create(filePath)
+	}
+	if err != nil {
+		return err
+	}
+	writePath := file.Name()
+	inFlight.add(writePath)
+	defer file.Close()
+
+	var dst downloadTarget = file
+	dlCtx := ctx
+	if opts.minThroughput > 0 {
+		var stop func()
+		dlCtx, dst, stop = watchStalls(ctx, file, opts.minThroughput, opts.stallWindow)
+		defer stop()
+	}
+	if opts.rangeBytes > 0 {
+		err = downloadRange(dlCtx, svc, dst, input, opts.rangeBytes)
+	} else {
+		_, err = downloader.Download(dlCtx, dst, input)
+	}
+	if err != nil && ctx.Err() == nil && errors.Is(context.Cause(dlCtx), errStalled) {
+		err = fmt.Errorf("%w: under %d bytes/s for %s", errStalled, opts.minThroughput, opts.stallWindow)
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		if stageDir != "" {
+			file.Close()
+			os.Remove(writePath)
+			inFlight.remove(writePath)
+		}
+		return err
+	}
+
+	if stageDir != "" {
+		if err := moveFile(writePath, filePath); err != nil {
+			os.Remove(writePath)
+			inFlight.remove(writePath)
+			return err
+		}
+	}
+	inFlight.remove(writePath)
+	return nil
+}
+
+// fetchToMemory downloads key into a buffer and returns its content, or
+// only the first rangeBytes bytes when that is positive.
+func fetchToMemory(ctx context.Context, svc *s3.Client, downloader *manager.Downloader, bucket, key string, rangeBytes int64) ([]byte, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if rangeBytes > 0 {
+		var buf bytes.Buffer
+		if err := downloadRange(ctx, svc, &buf, input, rangeBytes); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	buf := manager.NewWriteAtBuffer(nil)
+	if _, err := downloader.Download(ctx, buf, input); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// existingCopy returns the local file that stands for the object at
+// filePath and its FileInfo: filePath itself, or for a .gz whose download
+// was already decompressed, the output d gave it, which with d.outDir is
+// below that directory. path is empty if there is neither.
+func existingCopy(filePath string, d decompressOptions) (path string, info os.FileInfo) {
+	candidates := []string{filePath}
+	if strings.HasSuffix(filePath, ".gz") {
+		if out, err := d.outputPath(filePath); err == nil {
+			candidates = append(candidates, d.finishedOutput(out))
+		}
+	}
+	for _, p := range candidates {
+		if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() {
+			return p, info
+		}
+	}
+	return "", nil
+}
+
+// isNotModified reports whether err is S3's 304 answer to a conditional
+// request.
+func isNotModified(err error) bool {
+	var re *awshttp.ResponseError
+	return errors.As(err, &re) && re.HTTPStatusCode() == http.StatusNotModified
+}
+
+// moveFile renames src to dst, falling back to copy-then-remove when the
+// rename fails, typically because the two are on different filesystems.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return fmt.Errorf("copy %s to %s: %w", src, dst, err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
+
+// downloadRange writes the first n bytes of the object to w. The transfer
+// manager splits objects into its own ranged parts, so a caller-chosen Range
+// has to go through GetObject directly.
+func downloadRange(ctx context.Context, svc *s3.Client, w io.Writer, input *s3.GetObjectInput, n int64) error {
+	input.Range = aws.String(fmt.Sprintf("bytes=0-%d", n-1))
+	out, err := svc.GetObject(ctx, input)
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+	_, err = io.Copy(w, out.Body)
+	return err
+}
+
+// pathSet is a mutex-guarded set of local paths shared by download workers.
+type pathSet struct {
+	mu    sync.Mutex
+	paths map[string]struct{}
+}
+
+func newPathSet() *pathSet {
+	return &pathSet{paths: make(map[string]struct{})}
+}
+
+func (s *pathSet) add(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paths[path] = struct{}{}
+}
+
+func (s *pathSet) remove(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.paths, path)
+}
+
+func (s *pathSet) list() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths := make([]string, 0, len(s.paths))
+	for path := range s.paths {
+		paths = append(paths, path)
+	}
+	return paths
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// newStubClient returns an S3 client that sends every request, path-style,
+// to handler.
+func newStubClient(t *testing.T, handler http.Handler) *s3.Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return s3.New(s3.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String(srv.URL),
+		UsePathStyle:     true,
+		Credentials:      credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+		RetryMaxAttempts: 1,
+	})
+}
+
+func discardLogger() *log.Logger {
+	return log.New(io.Discard, "", 0)
+}
+
+// slowBody serves every GetObject as a body of size bytes that stops after
+// the first half until the request is abandoned, closing started once that
+// half is out.
+func slowBody(size int, started chan<- struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", size-1, size))
+		w.Header().Set("ETag", `"abc"`)
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(make([]byte, size/2))
+		w.(http.Flusher).Flush()
+		close(started)
+		<-r.Context().Done()
+	})
+}
+
+func TestDownloadInterruptedLeavesNoPartialFiles(t *testing.T) {
+	for _, staged := range []bool{false, true} {
+		t.Run(fmt.Sprintf("staged=%t", staged), func(t *testing.T) {
+			started := make(chan struct{})
+			svc := newStubClient(t, slowBody(1<<20, started))
+			dir := t.TempDir()
+			opts := downloadOptions{onExisting: onExistingOverwrite, minConcurrency: 1, maxConcurrency: 1}
+			if staged {
+				opts.tempDir = t.TempDir()
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				<-started
+				cancel()
+			}()
+			err := downloadFiles(ctx, discardLogger(), svc, "bucket", dir, []string{"data/x.json.gz"}, opts)
+			if err == nil {
+				t.Fatal("interrupted download reported no error")
+			}
+
+			for _, root := range []string{dir, opts.tempDir} {
+				if root == "" {
+					continue
+				}
+				filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+					if err == nil && !info.IsDir() {
+						t.Errorf("%s left behind", path)
+					}
+					return nil
+				})
+			}
+		})
+	}
+}
+
+func TestOnExistingFindsDecompressedCopy(t *testing.T) {
+	for _, separate := range []bool{false, true} {
+		t.Run(fmt.Sprintf("outDir=%t", separate), func(t *testing.T) {
+			dir := t.TempDir()
+			d := decompressOptions{srcDir: dir}
+			out := filepath.Join(dir, "data", "x.json")
+			if separate {
+				d.outDir = t.TempDir()
+				out = filepath.Join(d.outDir, "data", "x.json")
+			}
+			os.MkdirAll(filepath.Dir(out), 0o755)
+			os.WriteFile(out, []byte("{}\n"), 0o644)
+			keys := []string{"data/x.json.gz", "data/y.json.gz"}
+			opts := downloadOptions{onExisting: onExistingSkip, minConcurrency: 1, maxConcurrency: 1, decompressed: d}
+
+			if got := existingTargets(dir, keys, opts); len(got) != 1 || got[0] != out {
+				t.Errorf("existingTargets = %v, want [%s]", got, out)
+			}
+
+			var fetched []string
+			svc := newStubClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetched = append(fetched, r.URL.Path)
+				w.Write([]byte("gz"))
+			}))
+			if err := downloadFiles(context.Background(), discardLogger(), svc, "bucket", dir, keys, opts); err != nil {
+				t.Fatal(err)
+			}
+			if len(fetched) != 1 || fetched[0] != "/bucket/data/y.json.gz" {
+				t.Errorf("fetched %v, want only the key without a local copy", fetched)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+const (
+	dumpConfigTable = "table"
+	dumpConfigJSON  = "json"
+)
+
+// effectiveConfig is what -dump-config prints: the settings a run would use
+// once flags, environment and profile are resolved. Secrets are never part
+// of it, only where credentials come from, and headers show their names
+// but not their values.
+type effectiveConfig struct {
+	Buckets               []string          `json:"buckets"`
+	BucketRegions         map[string]string `json:"bucket_regions,omitempty"`
+	Prefixes              []string          `json:"prefixes"`
+	Out                   string            `json:"out"`
+	Region                string            `json:"region"`
+	Profile               string            `json:"profile,omitempty"`
+	Endpoint              string            `json:"endpoint,omitempty"`
+	SigningRegion         string            `json:"signing_region,omitempty"`
+	Headers               []string          `json:"headers,omitempty"`
+	CredentialsSource     string            `json:"credentials_source"`
+	CredentialsProvider   string            `json:"credentials_provider"`
+	SharedCredentialsFile string            `json:"shared_credentials_file,omitempty"`
+	SharedConfigFile      string            `json:"shared_config_file,omitempty"`
+	MinConcurrency        int               `json:"min_concurrency"`
+	MaxConcurrency        int               `json:"max_concurrency"`
+	ListWorkers           int               `json:"list_workers"`
+	PageSize              int32             `json:"page_size"`
+	StartAfter            string            `json:"start_after,omitempty"`
+	IncludeNonMatching    bool              `json:"include_non_matching"`
+	SkipEmpty             bool              `json:"skip_empty"`
+	NonRecursive          bool              `json:"non_recursive"`
+	MinAge                string            `json:"min_age"`
+	SinceLastRun          bool              `json:"since_last_run"`
+	ContentType           string            `json:"content_type,omitempty"`
+	OnExisting            string            `json:"on_existing"`
+	UploadTo              string            `json:"upload_to,omitempty"`
+	DecompressWorkers     int               `json:"decompress_workers"`
+}
+
+// resolveConfig fills in an effectiveConfig from opts and the loaded cfg,
+// and from regions if a multi-bucket run looked its buckets' regions up.
+// The credentials are retrieved once to find out which provider supplies
+// them; a failure is reported in their place rather than returned.
+func resolveConfig(ctx context.Context, cfg aws.Config, opts options, regions *regionClients) effectiveConfig {
+	c := effectiveConfig{
+		Prefixes:              opts.prefixes,
+		Out:                   opts.localDir,
+		Region:                cfg.Region,
+		Profile:               opts.profile,
+		Endpoint:              opts.endpoint,
+		SigningRegion:         opts.signingRegion,
+		CredentialsSource:     opts.credentialsSource,
+		SharedCredentialsFile: opts.sharedCredentialsFile,
+		SharedConfigFile:      opts.sharedConfigFile,
+		MinConcurrency:        opts.download.minConcurrency,
+		MaxConcurrency:        opts.download.maxConcurrency,
+		ListWorkers:           opts.list.workers,
+		PageSize:              opts.list.pageSize,
+		StartAfter:            opts.list.startAfter,
+		IncludeNonMatching:    opts.list.includeNonMatching,
+		SkipEmpty:             opts.list.skipEmpty,
+		NonRecursive:          opts.list.nonRecursive,
+		MinAge:                opts.list.minAge.String(),
+		SinceLastRun:          opts.sinceLastRun,
+		ContentType:           opts.contentType,
+		OnExisting:            opts.download.onExisting,
+		UploadTo:              opts.uploadTo,
+		DecompressWorkers:     opts.pipelineWorkers,
+	}
+	if len(opts.buckets) == 0 {
+		c.Buckets = []string{opts.bucket}
+	}
+	for _, t := range opts.buckets {
+		c.Buckets = append(c.Buckets, "s3://"+t.bucket+"/"+t.prefix)
+	}
+	if len(c.Prefixes) == 0 {
+		c.Prefixes = []string{opts.prefix}
+	}
+	if regions != nil {
+		c.BucketRegions = regions.mappings()
+	}
+	for _, h := range opts.headers {
+		c.Headers = append(c.Headers, h.name)
+	}
+	switch {
+	case opts.accessKey != "":
+		c.CredentialsSource = "flags"
+	case c.CredentialsSource == "":
+		c.CredentialsSource = "default chain"
+	}
+
+	if opts.credentialsTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.credentialsTimeout)
+		defer cancel()
+	}
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		c.CredentialsProvider = "error: " + err.Error()
+	} else {
+		c.CredentialsProvider = creds.Source
+	}
+	return c
+}
+
+// dumpConfig writes the effective configuration to w in format, a table or
+// one JSON object.
+func dumpConfig(ctx context.Context, w io.Writer, cfg aws.Config, opts options, regions *regionClients) error {
+	c := resolveConfig(ctx, cfg, opts, regions)
+	if opts.dumpConfig == dumpConfigJSON {
+		data, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	}
+
+	none := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Buckets:\t%s\n", strings.Join(c.Buckets, ", "))
+	fmt.Fprintf(tw, "Prefixes:\t%s\n", strings.Join(c.Prefixes, ", "))
+	fmt.Fprintf(tw, "Output directory:\t%s\n", c.Out)
+	fmt.Fprintf(tw, "Region:\t%s\n", c.Region)
+	for _, bucket := range slices.Sorted(maps.Keys(c.BucketRegions)) {
+		fmt.Fprintf(tw, "Region of %s:\t%s\n", bucket, c.BucketRegions[bucket])
+	}
+	fmt.Fprintf(tw, "Profile:\t%s\n", none(c.Profile))
+	fmt.Fprintf(tw, "Endpoint:\t%s\n", none(c.Endpoint))
+	fmt.Fprintf(tw, "Signing region:\t%s\n", none(c.SigningRegion))
+	fmt.Fprintf(tw, "Extra headers:\t%s\n", none(strings.Join(c.Headers, ", ")))
+	fmt.Fprintf(tw, "Credentials source:\t%s\n", c.CredentialsSource)
+	fmt.Fprintf(tw, "Credentials provider:\t%s\n", c.CredentialsProvider)
+	fmt.Fprintf(tw, "Shared credentials file:\t%s\n", none(c.SharedCredentialsFile))
+	fmt.Fprintf(tw, "Shared config file:\t%s\n", none(c.SharedConfigFile))
+	fmt.Fprintf(tw, "Concurrency:\t%d-%d\n", c.MinConcurrency, c.MaxConcurrency)
+	fmt.Fprintf(tw, "List workers:\t%d\n", c.ListWorkers)
+	fmt.Fprintf(tw, "Page size:\t%d\n", c.PageSize)
+	fmt.Fprintf(tw, "Start after:\t%s\n", none(c.StartAfter))
+	fmt.Fprintf(tw, "Include non-matching:\t%t\n", c.IncludeNonMatching)
+	fmt.Fprintf(tw, "Skip empty:\t%t\n", c.SkipEmpty)
+	fmt.Fprintf(tw, "Non-recursive:\t%t\n", c.NonRecursive)
+	fmt.Fprintf(tw, "Minimum age:\t%s\n", c.MinAge)
+	fmt.Fprintf(tw, "Since last run:\t%t\n", c.SinceLastRun)
+	fmt.Fprintf(tw, "Content type:\t%s\n", none(c.ContentType))
+	fmt.Fprintf(tw, "On existing:\t%s\n", c.OnExisting)
+	fmt.Fprintf(tw, "Upload to:\t%s\n", none(c.UploadTo))
+	fmt.Fprintf(tw, "Decompress workers:\t%d\n", c.DecompressWorkers)
+	return tw.Flush()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+)
+
+// errorSample is the detail -error-sample keeps about one failed download:
+// what S3 answered, as far as the error says, and the IDs AWS support asks
+// for.
+type errorSample struct {
+	Key        string `json:"key"`
+	Error      string `json:"error"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Code       string `json:"code,omitempty"`
+	Message    string `json:"message,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+	HostID     string `json:"host_id,omitempty"`
+}
+
+// errorSampler logs the full S3 error of the first limit failed downloads,
+// and optionally writes them to a file as JSON lines. Later failures are
+// only counted, so a run where everything fails doesn't log a wall of
+// identical errors.
+type errorSampler struct {
+	logger *log.Logger
+	limit  int
+	path   string
+
+	mu      sync.Mutex
+	samples []errorSample
+	dropped int
+}
+
+func newErrorSampler(logger *log.Logger, limit int, path string) *errorSampler {
+	return &errorSampler{logger: logger, limit: limit, path: path}
+}
+
+// sampleError picks the structured details out of err, which may wrap an
+// API error, an HTTP response error, or neither.
+func sampleError(key string, err error) errorSample {
+	sample := errorSample{Key: key, Error: err.Error()}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		sample.Code = apiErr.ErrorCode()
+		sample.Message = apiErr.ErrorMessage()
+	}
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		sample.StatusCode = respErr.HTTPStatusCode()
+		sample.RequestID = respErr.ServiceRequestID()
+	}
+	// S3's response errors also carry the extended request ID.
+	var hostErr interface{ ServiceHostID() string }
+	if errors.As(err, &hostErr) {
+		sample.HostID = hostErr.ServiceHostID()
+	}
+	return sample
+}
+
+// hook has the shape of downloadOptions.onComplete. Duplicates and
+// downloads cut short by the run ending aren't failures worth sampling.
+func (s *errorSampler) hook(key, _ string, err error) {
+	if err == nil || errors.Is(err, errDuplicate) || errors.Is(err, context.Canceled) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.samples) >= s.limit {
+		s.dropped++
+		return
+	}
+	sample := sampleError(key, err)
+	s.samples = append(s.samples, sample)
+	s.logger.Printf("Error sample %d: %s: HTTP status %d, code %q, message %q, request ID %q, host ID %q",
+		len(s.samples), key, sample.StatusCode, sample.Code, sample.Message, sample.RequestID, sample.HostID)
+}
+
+// finish writes the samples to the file, if one was given, and says how
+// many failures went unsampled.
+func (s *errorSampler) finish() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dropped > 0 {
+		s.logger.Printf("Sampled %d failed downloads; %d more were not sampled", len(s.samples), s.dropped)
+	}
+	if s.path == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, sample := range s.samples {
+		if err := enc.Encode(sample); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(s.path, buf.Bytes()); err != nil {
+		return fmt.Errorf("write error samples: %w", err)
+	}
+	return nil
+}
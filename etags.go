@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	listETagsText = "text"
+	listETagsJSON = "json"
+)
+
+// etagEntry is one line of -list-etags json output.
+type etagEntry struct {
+	Key  string `json:"key"`
+	ETag string `json:"etag"`
+}
+
+// printETags writes the ETag and key of every object in key order, as
+// "etag  key" lines or in format json as one object per line, so two dumps
+// of the same prefix can be diffed line by line. ETags are printed without
+// the quotes S3 puts around them.
+func printETags(w io.Writer, objects []types.Object, format string) error {
+	entries := make([]etagEntry, len(objects))
+	for i, obj := range objects {
+		entries[i] = etagEntry{Key: aws.ToString(obj.Key), ETag: strings.Trim(aws.ToString(obj.ETag), `"`)}
+	}
+	slices.SortFunc(entries, func(a, b etagEntry) int { return strings.Compare(a.Key, b.Key) })
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, e := range entries {
+		if format == listETagsJSON {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Fprintf(bw, "%s  %s\n", e.ETag, e.Key)
+	}
+	return bw.Flush()
+}
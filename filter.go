@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// filterByContentType keeps the objects whose Content-Type has the media
+// type want, ignoring parameters such as charset. The listing doesn't carry
+// content types, so this costs one HeadObject per object, at most workers at
+// a time.
+func filterByContentType(ctx context.Context, logger *log.Logger, svc *s3.Client, bucket string, objects []types.Object, want string, workers int) ([]types.Object, error) {
+	logger.Printf("Checking the content type of %d objects (one HEAD request each)", len(objects))
+
+	keep := make([]bool, len(objects))
+	err := headObjects(ctx, svc, bucket, objects, workers, func(i int, out *s3.HeadObjectOutput) {
+		keep[i] = mediaType(aws.ToString(out.ContentType)) == want
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var kept []types.Object
+	for i, obj := range objects {
+		if keep[i] {
+			kept = append(kept, obj)
+		}
+	}
+	return kept, nil
+}
+
+// headObjects issues a HeadObject for every object, at most workers at a
+// time, and passes each response to fn with the object's index. fn may be
+// called concurrently. Every failure is returned joined together.
+func headObjects(ctx context.Context, svc *s3.Client, bucket string, objects []types.Object, workers int, fn func(i int, out *s3.HeadObjectOutput)) error {
+	var mu sync.Mutex
+	var errs []error
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, obj := range objects {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			out, err := svc.HeadObject(ctx, &s3.HeadObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    obj.Key,
+			})
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("head %s: %w", aws.ToString(obj.Key), err))
+				mu.Unlock()
+				return
+			}
+			fn(i, out)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// mediaType returns the lower-cased media type of a Content-Type value.
+func mediaType(contentType string) string {
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mt
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// dropOversized leaves out the objects larger than limit bytes, logging a
+// warning for each, and returns the rest with how many were dropped.
+func dropOversized(logger *log.Logger, objects []types.Object, limit int64) ([]types.Object, int) {
+	kept := objects[:0:0]
+	for _, obj := range objects {
+		if oversized(logger, obj, limit) {
+			continue
+		}
+		kept = append(kept, obj)
+	}
+	return kept, len(objects) - len(kept)
+}
+
+// oversized reports whether obj is larger than limit bytes, as listed, and
+// if so logs that it is skipped.
+func oversized(logger *log.Logger, obj types.Object, limit int64) bool {
+	size := aws.ToInt64(obj.Size)
+	if size <= limit {
+		return false
+	}
+	logger.Printf("Warning: skipping %s: its size of %s is over -max-object-size %s", aws.ToString(obj.Key), formatBytes(size), formatBytes(limit))
+	return true
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"net/textproto"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// requestHeader is one extra header given to -header.
+type requestHeader struct {
+	name  string
+	value string
+}
+
+// headerFlag collects repeated -header values of the form "Name: Value".
+// String leaves the values out, since they are often credentials.
+type headerFlag []requestHeader
+
+func (f *headerFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	names := make([]string, len(*f))
+	for i, h := range *f {
+		names[i] = h.name
+	}
+	return strings.Join(names, ",")
+}
+
+func (f *headerFlag) Set(value string) error {
+	name, val, ok := strings.Cut(value, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		return errors.New("want 'Name: Value'")
+	}
+	*f = append(*f, requestHeader{name: textproto.CanonicalMIMEHeaderKey(name), value: strings.TrimSpace(val)})
+	return nil
+}
+
+// addRequestHeaders makes every request of the client, listing, HEAD and
+// GET alike, carry headers. They are added before signing, so they are
+// part of the signature like any other header.
+func addRequestHeaders(o *s3.Options, headers []requestHeader) {
+	for _, h := range headers {
+		o.APIOptions = append(o.APIOptions, smithyhttp.AddHeaderValue(h.name, h.value))
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package main
+
+// freeInodes is not supported here; see inodes_unix.go.
+func freeInodes(dir string) (free uint64, ok bool, err error) {
+	return 0, false, nil
+}
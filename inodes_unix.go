@@ -0,0 +1,18 @@
+//go:build linux || darwin
+
+package main
+
+import "syscall"
+
+// freeInodes reports how many inodes are available on the filesystem that
+// holds dir. ok is false when the filesystem has no fixed inode count.
+func freeInodes(dir string) (free uint64, ok bool, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, false, err
+	}
+	if st.Files == 0 {
+		return 0, false, nil
+	}
+	return uint64(st.Ffree), true, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// errUnverifiable fails a download under -require-checksum when S3 holds
+// no checksum of the whole object to check it against. Such objects are
+// not downloaded at all.
+var errUnverifiable = errors.New("no checksum to verify the object against")
+
+// errChecksumMismatch fails a download whose content doesn't hash to the
+// checksum S3 holds for it.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// crc64NVME is the CRC-64/NVME table S3's CRC64NVME checksums use, in the
+// reversed form hash/crc64 expects.
+var crc64NVME = crc64.MakeTable(0x9a6c9329ac4bc9b5)
+
+// expectedChecksum is the checksum a downloaded object must match: MD5 as
+// hex, from a plain ETag, or one of S3's additional checksums as base64,
+// the way S3 returns them.
+type expectedChecksum struct {
+	algorithm string
+	value     string
+	// etag is the ETag the checksum belongs to; the download is made
+	// conditional on it so it can't fetch a version written since.
+	etag string
+}
+
+// objectChecksum looks up the checksum to verify the object input fetches
+// against. A full-object additional checksum is preferred to the ETag;
+// composite checksums of multipart uploads only cover each part, so an
+// object uploaded that way is only verifiable if it also has a plain MD5
+// ETag, which multipart uploads don't. Objects encrypted with KMS or a
+// customer key have ETags that aren't their MD5 either.
+func objectChecksum(ctx context.Context, svc *s3.Client, input *s3.GetObjectInput) (expectedChecksum, error) {
+	head, err := svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       input.Bucket,
+		Key:          input.Key,
+		VersionId:    input.VersionId,
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		return expectedChecksum{}, fmt.Errorf("look up checksum: %w", err)
+	}
+	want := expectedChecksum{etag: aws.ToString(head.ETag)}
+	if head.ChecksumType != types.ChecksumTypeComposite {
+		for _, c := range []struct {
+			algorithm string
+			value     *string
+		}{
+			{"SHA256", head.ChecksumSHA256},
+			{"SHA1", head.ChecksumSHA1},
+			{"CRC64NVME", head.ChecksumCRC64NVME},
+			{"CRC32C", head.ChecksumCRC32C},
+			{"CRC32", head.ChecksumCRC32},
+		} {
+			// Composite values end in -<parts>, even where the type is
+			// missing from the response.
+			if v := aws.ToString(c.value); v != "" && !strings.Contains(v, "-") {
+				want.algorithm, want.value = c.algorithm, v
+				return want, nil
+			}
+		}
+	}
+	encrypted := head.ServerSideEncryption == types.ServerSideEncryptionAwsKms ||
+		head.ServerSideEncryption == types.ServerSideEncryptionAwsKmsDsse || head.SSECustomerAlgorithm != nil
+	if sum, ok := etagMD5(want.etag); ok && !encrypted {
+		want.algorithm, want.value = "MD5", sum
+		return want, nil
+	}
+	return want, fmt.Errorf("%w: ETag %s is not an MD5 of the content and there is no full-object checksum", errUnverifiable, want.etag)
+}
+
+// verify hashes the file at path and compares it with the checksum.
+func (e expectedChecksum) verify(path string) error {
+	var h hash.Hash
+	switch e.algorithm {
+	case "MD5":
+		h = md5.New()
+	case "SHA256":
+		h = sha256.New()
+	case "SHA1":
+		h = sha1.New()
+	case "CRC64NVME":
+		h = crc64.New(crc64NVME)
+	case "CRC32C":
+		h = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case "CRC32":
+		h = crc32.NewIEEE()
+	default:
+		return fmt.Errorf("unknown checksum algorithm %s", e.algorithm)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("hash %s: %w", path, err)
+	}
+	got := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	if e.algorithm == "MD5" {
+		got = hex.EncodeToString(h.Sum(nil))
+	}
+	if got != e.value {
+		return fmt.Errorf("%w: %s of the download is %s, S3 has %s", errChecksumMismatch, e.algorithm, got, e.value)
+	}
+	return nil
+}
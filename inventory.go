@@ -0,0 +1,205 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// inventoryManifest is the manifest.json S3 Inventory writes next to each
+// report's data files.
+type inventoryManifest struct {
+	SourceBucket      string `json:"sourceBucket"`
+	DestinationBucket string `json:"destinationBucket"`
+	FileFormat        string `json:"fileFormat"`
+	FileSchema        string `json:"fileSchema"`
+	CreationTimestamp string `json:"creationTimestamp"`
+	Files             []struct {
+		Key string `json:"key"`
+	} `json:"files"`
+}
+
+// inventoryColumns locates the fields we use in a CSV inventory row, by the
+// names in the manifest's fileSchema. Only Key is required; IsLatest and
+// IsDeleteMarker are only there in inventories that include all versions.
+type inventoryColumns struct {
+	key, size, lastModified, etag, isLatest, isDeleteMarker int
+}
+
+func parseInventorySchema(schema string) (inventoryColumns, error) {
+	cols := inventoryColumns{-1, -1, -1, -1, -1, -1}
+	for i, name := range strings.Split(schema, ",") {
+		switch strings.TrimSpace(name) {
+		case "Key":
+			cols.key = i
+		case "Size":
+			cols.size = i
+		case "LastModifiedDate":
+			cols.lastModified = i
+		case "ETag":
+			cols.etag = i
+		case "IsLatest":
+			cols.isLatest = i
+		case "IsDeleteMarker":
+			cols.isDeleteMarker = i
+		}
+	}
+	if cols.key < 0 {
+		return cols, fmt.Errorf("inventory schema %q has no Key column", schema)
+	}
+	return cols, nil
+}
+
+// inventoryObjects reads the S3 Inventory report whose manifest.json is at
+// manifestURL and returns the current objects of bucket under prefixes that
+// pass the same filters as a listing, instead of listing the bucket. Only
+// CSV inventories are supported. An inventory is a daily or weekly
+// snapshot, so objects written since it was taken are missing.
+func inventoryObjects(ctx context.Context, logger *log.Logger, svc *s3.Client, manifestURL, bucket string, prefixes []string, opts listOptions) ([]types.Object, error) {
+	manifestBucket, manifestKey, err := parseS3URL(manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	out, err := svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(manifestBucket),
+		Key:    aws.String(manifestKey),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get inventory manifest %s: %w", manifestURL, err)
+	}
+	var manifest inventoryManifest
+	err = json.NewDecoder(out.Body).Decode(&manifest)
+	out.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("parse inventory manifest %s: %w", manifestURL, err)
+	}
+
+	if manifest.SourceBucket != bucket {
+		return nil, fmt.Errorf("inventory %s is of bucket %s, not %s", manifestURL, manifest.SourceBucket, bucket)
+	}
+	if manifest.FileFormat != "CSV" {
+		return nil, fmt.Errorf("inventory %s is in %s format; only CSV inventories are supported", manifestURL, manifest.FileFormat)
+	}
+	cols, err := parseInventorySchema(manifest.FileSchema)
+	if err != nil {
+		return nil, err
+	}
+	// The data files live in the destination bucket, given as an ARN.
+	dataBucket := strings.TrimPrefix(manifest.DestinationBucket, "arn:aws:s3:::")
+	if dataBucket == "" {
+		dataBucket = manifestBucket
+	}
+	if ms, err := strconv.ParseInt(manifest.CreationTimestamp, 10, 64); err == nil {
+		logger.Printf("Reading inventory of s3://%s taken %s, %d data file(s)", bucket, time.UnixMilli(ms).UTC().Format(time.RFC3339), len(manifest.Files))
+	}
+
+	// Keys in the report are already decoded by readInventoryFile.
+	opts.urlEncoding = false
+	var objects []types.Object
+	for _, file := range manifest.Files {
+		rows, err := readInventoryFile(ctx, svc, dataBucket, file.Key, cols)
+		if err != nil {
+			return nil, err
+		}
+		var candidates []types.Object
+		for _, obj := range rows {
+			if opts.inventoryWants(aws.ToString(obj.Key), prefixes) {
+				candidates = append(candidates, obj)
+			}
+		}
+		selected := opts.selectObjects(logger, candidates)
+		objects = append(objects, selected...)
+		if opts.progress != nil {
+			opts.progress.record(logger, len(rows), len(selected))
+		}
+	}
+	return objects, nil
+}
+
+// inventoryWants applies to an inventory key what the listing gets from S3
+// itself: it is under one of prefixes, after startAfter, and with
+// nonRecursive not in a sub-prefix.
+func (o listOptions) inventoryWants(key string, prefixes []string) bool {
+	if o.startAfter != "" && key <= o.startAfter {
+		return false
+	}
+	for _, prefix := range prefixes {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if ok && !(o.nonRecursive && strings.Contains(rest, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// readInventoryFile returns the current objects in one gzipped CSV data
+// file of an inventory report. Noncurrent versions and delete markers are
+// left out.
+func readInventoryFile(ctx context.Context, svc *s3.Client, bucket, key string, cols inventoryColumns) ([]types.Object, error) {
+	out, err := svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get inventory file s3://%s/%s: %w", bucket, key, err)
+	}
+	defer out.Body.Close()
+	gz, err := gzip.NewReader(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read inventory file s3://%s/%s: %w", bucket, key, err)
+	}
+	defer gz.Close()
+
+	field := func(row []string, i int) string {
+		if i < 0 || i >= len(row) {
+			return ""
+		}
+		return row[i]
+	}
+	var objects []types.Object
+	r := csv.NewReader(gz)
+	r.FieldsPerRecord = -1
+	for {
+		row, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read inventory file s3://%s/%s: %w", bucket, key, err)
+		}
+		if field(row, cols.isLatest) == "false" || field(row, cols.isDeleteMarker) == "true" {
+			continue
+		}
+		// Inventory reports URL-encode keys.
+		objKey, err := url.QueryUnescape(field(row, cols.key))
+		if err != nil {
+			return nil, fmt.Errorf("inventory file s3://%s/%s: decode key %q: %w", bucket, key, field(row, cols.key), err)
+		}
+		obj := types.Object{Key: aws.String(objKey)}
+		if size, err := strconv.ParseInt(field(row, cols.size), 10, 64); err == nil {
+			obj.Size = aws.Int64(size)
+		}
+		if t, err := time.Parse(time.RFC3339, field(row, cols.lastModified)); err == nil {
+			obj.LastModified = aws.Time(t)
+		}
+		if etag := field(row, cols.etag); etag != "" {
+			// The listing quotes ETags; the inventory doesn't.
+			obj.ETag = aws.String(`"` + etag + `"`)
+		}
+		objects = append(objects, obj)
+	}
+	return objects, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+)
+
+// adaptiveLimiter bounds concurrent downloads to a limit that moves between
+// min and max. It starts at start, grows by one after a full limit's worth
+// of consecutive successes, and halves whenever a request is throttled.
+// With min == max it behaves like a plain semaphore. Every change of the
+// limit is logged.
+type adaptiveLimiter struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	logger *log.Logger
+
+	min, max  int
+	limit     int
+	inUse     int
+	successes int
+}
+
+func newAdaptiveLimiter(logger *log.Logger, min, start, max int) *adaptiveLimiter {
+	l := &adaptiveLimiter{logger: logger, min: min, max: max, limit: start}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire blocks until a slot is free under the current limit.
+func (l *adaptiveLimiter) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.inUse >= l.limit {
+		l.cond.Wait()
+	}
+	l.inUse++
+}
+
+// release frees a slot and feeds the request's outcome into the limit.
+func (l *adaptiveLimiter) release(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inUse--
+
+	switch {
+	case isThrottle(err):
+		if limit := max(l.min, l.limit/2); limit != l.limit {
+			l.logger.Printf("Throttled by S3, lowering download concurrency from %d to %d", l.limit, limit)
+			l.limit = limit
+		}
+		l.successes = 0
+	case err == nil:
+		l.successes++
+		if l.successes >= l.limit && l.limit < l.max {
+			l.limit++
+			l.successes = 0
+			l.logger.Printf("Raising download concurrency to %d", l.limit)
+		}
+	}
+	l.cond.Broadcast()
+}
+
+// isThrottle reports whether err is S3 asking the client to slow down,
+// either through a throttling error code or an HTTP 503.
+func isThrottle(err error) bool {
+	if err == nil {
+		return false
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequestsException":
+			return true
+		}
+	}
+	var respErr *awshttp.ResponseError
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == 503
+}
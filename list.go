@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// maxListPageSize is the largest MaxKeys value S3 honours for ListObjectsV2.
+const maxListPageSize = 1000
+
+// matchSuffix selects which keys are downloaded and later decompressed.
+const matchSuffix = ".json.gz"
+
+// listOptions tunes how collectRecursive pages through ListObjectsV2.
+type listOptions struct {
+	pageSize int32
+	// startAfter is passed as StartAfter on every request, including the
+	// recursive ones for each CommonPrefix. S3 compares it against full keys,
+	// so sub-prefixes sorting entirely before it come back empty and the ones
+	// after it are listed in full.
+	startAfter string
+	// skipEmpty drops zero-byte objects, such as marker files, that would
+	// otherwise match the suffix filter.
+	skipEmpty bool
+	// includeNonMatching collects every object under the prefix, not only
+	// those ending in matchSuffix. Decompression still only touches matching
+	// files, so everything else is mirrored as-is.
+	includeNonMatching bool
+	// modifiedAfter, when non-zero, drops objects whose LastModified is not
+	// strictly after it. S3 can't filter on time, so this happens client-side.
+	modifiedAfter time.Time
+	// minAge, when positive, drops objects whose LastModified is less than
+	// that long ago, which may still be being written by their producer.
+	minAge time.Duration
+	// newest, when non-nil, observes the LastModified of every collected key.
+	newest *watermark
+	// nonRecursive lists only the objects directly under the prefix and
+	// ignores its sub-prefixes.
+	nonRecursive bool
+	// urlEncoding asks S3 to URL-encode keys in list responses, which keeps
+	// keys with unusual characters intact in the XML. They are decoded
+	// before any matching or use.
+	urlEncoding bool
+	// verbose logs every matching key as it is found.
+	verbose bool
+	// progress, when non-nil, is shared by every level of the recursion.
+	progress *listProgress
+	// skipped, when set, makes a prefix that fails to list get logged and
+	// recorded there instead of failing the whole listing.
+	skipped *prefixList
+	// parallelDepth, when positive, lists the sub-prefixes found that many
+	// levels below the starting prefix concurrently, up to workers at a
+	// time, each one serially below that. depth is the level being listed.
+	parallelDepth int
+	workers       int
+	depth         int
+	// dirMarkers, when set, collects the folder placeholder keys (ending in
+	// '/') found while listing. They are never selected as objects.
+	dirMarkers *prefixList
+	// found, when set, is handed every selected object as soon as it is
+	// listed, and collectRecursive leaves them out of its result. It can be
+	// called from several goroutines at once.
+	found func(types.Object)
+	// pageDone, when set, is called after found has been handed the
+	// objects of each page.
+	pageDone func()
+	// continuationToken and maxFiles make collectPage list one contiguous
+	// slice of the prefix; see there.
+	continuationToken string
+	maxFiles          int
+}
+
+// prefixList collects keys or prefixes noted while listing, safely across
+// goroutines.
+type prefixList struct {
+	mu       sync.Mutex
+	prefixes []string
+}
+
+func (s *prefixList) add(prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prefixes = append(s.prefixes, prefix)
+}
+
+// list returns the collected entries in sorted order.
+func (s *prefixList) list() []string {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Sorted(slices.Values(s.prefixes))
+}
+
+// listProgress counts listed and matched objects and logs a running total at
+// most once per interval. Counters are atomic so it stays safe if listing is
+// ever spread across goroutines.
+type listProgress struct {
+	listed   atomic.Int64
+	matched  atomic.Int64
+	interval time.Duration
+
+	mu      sync.Mutex
+	lastLog time.Time
+}
+
+func newListProgress(interval time.Duration) *listProgress {
+	return &listProgress{interval: interval, lastLog: time.Now()}
+}
+
+// record adds a page's counts and logs the totals if interval has elapsed.
+func (p *listProgress) record(logger *log.Logger, listed, matched int) {
+	total := p.listed.Add(int64(listed))
+	found := p.matched.Add(int64(matched))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.lastLog) < p.interval {
+		return
+	}
+	p.lastLog = time.Now()
+	logger.Printf("Listed %d objects, %d matched so far", total, found)
+}
+
+// collectRecursive appends every selected object under prefix to objects,
+// descending one "/"-delimited level at a time. The first prefix that fails
+// to list stops it with an error, unless opts.skipped is set; then that
+// prefix is recorded and the rest are still listed.
+func collectRecursive(ctx context.Context, logger *log.Logger, svc *s3.Client, bucket, prefix string, opts listOptions, objects *[]types.Object) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+		MaxKeys:   aws.Int32(opts.pageSize),
+	}
+	if opts.startAfter != "" {
+		input.StartAfter = aws.String(opts.startAfter)
+	}
+	if opts.urlEncoding {
+		input.EncodingType = types.EncodingTypeUrl
+	}
+
+	sub := opts
+	sub.depth++
+	parallel := opts.parallelDepth > 0 && sub.depth == opts.parallelDepth
+	var pending []string
+
+	paginator := s3.NewListObjectsV2Paginator(svc, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			if opts.skipped == nil || ctx.Err() != nil {
+				return fmt.Errorf("list s3://%s/%s: %w", bucket, prefix, err)
+			}
+			logger.Printf("Skipping prefix %s after listing error: %v", prefix, err)
+			opts.skipped.add(prefix)
+			return nil
+		}
+
+		for _, cp := range page.CommonPrefixes {
+			if opts.nonRecursive {
+				break
+			}
+			subPrefix, err := opts.decode(*cp.Prefix)
+			if err != nil {
+				logger.Printf("Skipping prefix %q: %v", *cp.Prefix, err)
+				continue
+			}
+			if parallel {
+				pending = append(pending, subPrefix)
+				continue
+			}
+			if err := collectRecursive(ctx, logger, svc, bucket, subPrefix, sub, objects); err != nil {
+				return err
+			}
+		}
+
+		selected := opts.selectObjects(logger, page.Contents)
+		if opts.found != nil {
+			for _, obj := range selected {
+				opts.found(obj)
+			}
+			if opts.pageDone != nil {
+				opts.pageDone()
+			}
+		} else {
+			*objects = append(*objects, selected...)
+		}
+
+		if opts.progress != nil {
+			opts.progress.record(logger, len(page.Contents), len(selected))
+		}
+	}
+
+	if len(pending) > 0 {
+		found, err := collectPrefixes(ctx, logger, svc, bucket, pending, sub, opts.workers)
+		if err != nil {
+			return err
+		}
+		*objects = append(*objects, found...)
+	}
+	return nil
+}
+
+// selectObjects decodes the keys of one page of listed objects and returns
+// those that pass the filters, in order.
+func (o listOptions) selectObjects(logger *log.Logger, contents []types.Object) []types.Object {
+	var selected []types.Object
+	for _, obj := range contents {
+		key, err := o.decode(*obj.Key)
+		if err != nil {
+			logger.Printf("Skipping key %q: %v", *obj.Key, err)
+			continue
+		}
+		obj.Key = aws.String(key)
+
+		// Zero-byte "folder" objects made by the console and other
+		// tools have no file to become.
+		if strings.HasSuffix(key, "/") {
+			if o.verbose {
+				logger.Printf("Skipping folder marker %s", key)
+			}
+			if o.dirMarkers != nil {
+				o.dirMarkers.add(key)
+			}
+			continue
+		}
+		if o.skipEmpty && aws.ToInt64(obj.Size) == 0 {
+			continue
+		}
+		if !o.modifiedAfter.IsZero() && !aws.ToTime(obj.LastModified).After(o.modifiedAfter) {
+			continue
+		}
+		if o.minAge > 0 && time.Since(aws.ToTime(obj.LastModified)) < o.minAge {
+			if o.verbose {
+				logger.Printf("Skipping %s: modified less than -min-age %s ago", key, o.minAge)
+			}
+			continue
+		}
+		if o.includeNonMatching || strings.HasSuffix(key, matchSuffix) {
+			selected = append(selected, obj)
+			if o.newest != nil {
+				o.newest.observe(aws.ToTime(obj.LastModified))
+			}
+
+			if o.verbose {
+				logger.Printf("Found file: %s", key)
+			}
+		}
+	}
+	return selected
+}
+
+// collectPage lists prefix without a delimiter, as one stream of pages, from
+// opts.continuationToken if set. With opts.maxFiles it stops once that many
+// objects are selected, asking for no more keys per page than are still
+// wanted so that the listing ends exactly on a page boundary. It returns the
+// token that continues the listing from there, which is empty once the
+// prefix is exhausted. A token is only valid for the same bucket and prefix.
+func collectPage(ctx context.Context, logger *log.Logger, svc *s3.Client, bucket, prefix string, opts listOptions) ([]types.Object, string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	if opts.continuationToken != "" {
+		input.ContinuationToken = aws.String(opts.continuationToken)
+	}
+	if opts.startAfter != "" {
+		input.StartAfter = aws.String(opts.startAfter)
+	}
+	if opts.urlEncoding {
+		input.EncodingType = types.EncodingTypeUrl
+	}
+
+	var objects []types.Object
+	for {
+		input.MaxKeys = aws.Int32(opts.pageSize)
+		if left := opts.maxFiles - len(objects); opts.maxFiles > 0 && int32(left) < opts.pageSize {
+			input.MaxKeys = aws.Int32(int32(left))
+		}
+		page, err := svc.ListObjectsV2(ctx, input)
+		if err != nil {
+			return nil, "", fmt.Errorf("list s3://%s/%s: %w", bucket, prefix, err)
+		}
+		selected := opts.selectObjects(logger, page.Contents)
+		objects = append(objects, selected...)
+		if opts.progress != nil {
+			opts.progress.record(logger, len(page.Contents), len(selected))
+		}
+
+		next := aws.ToString(page.NextContinuationToken)
+		if !aws.ToBool(page.IsTruncated) || next == "" {
+			return objects, "", nil
+		}
+		if opts.maxFiles > 0 && len(objects) >= opts.maxFiles {
+			return objects, next, nil
+		}
+		input.ContinuationToken = aws.String(next)
+	}
+}
+
+// collectPrefixes lists each prefix with collectRecursive, up to workers at
+// a time, and returns the combined objects in prefix order. Keys reached
+// through more than one (overlapping) prefix are kept once. Listing errors
+// are returned joined together.
+func collectPrefixes(ctx context.Context, logger *log.Logger, svc *s3.Client, bucket string, prefixes []string, opts listOptions, workers int) ([]types.Object, error) {
+	results := make([][]types.Object, len(prefixes))
+	errs := make([]error, len(prefixes))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, prefix := range prefixes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs[i] = collectRecursive(ctx, logger, svc, bucket, prefix, opts, &results[i])
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var objects []types.Object
+	for _, result := range results {
+		for _, obj := range result {
+			if key := aws.ToString(obj.Key); !seen[key] {
+				seen[key] = true
+				objects = append(objects, obj)
+			}
+		}
+	}
+	return objects, nil
+}
+
+// readPrefixFile returns the prefixes in path, one per line. Surrounding
+// whitespace, blank lines and lines starting with '#' are ignored, as are
+// repeated prefixes.
+func readPrefixFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("read prefix file: %w", err)
+	}
+	defer f.Close()
+
+	var prefixes []string
+	seen := make(map[string]bool)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") || seen[line] {
+			continue
+		}
+		seen[line] = true
+		prefixes = append(prefixes, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read prefix file %s: %w", path, err)
+	}
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("prefix file %s has no prefixes", path)
+	}
+	return prefixes, nil
+}
+
+// decode undoes the URL encoding of a key or prefix from a list response
+// when urlEncoding is set.
+func (o listOptions) decode(s string) (string, error) {
+	if !o.urlEncoding {
+		return s, nil
+	}
+	decoded, err := url.QueryUnescape(s)
+	if err != nil {
+		return "", fmt.Errorf("decode URL-encoded key: %w", err)
+	}
+	return decoded, nil
+}
+
+// objectKeys returns the keys of objects, in order.
+func objectKeys(objects []types.Object) []string {
+	keys := make([]string, len(objects))
+	for i, obj := range objects {
+		keys[i] = aws.ToString(obj.Key)
+	}
+	return keys
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestDecodeURLEncodedKeys(t *testing.T) {
+	tests := []struct {
+		raw, want string
+	}{
+		{"a+b", "a b"},
+		{"a%20b", "a b"},
+		{"a%2Bb", "a+b"},
+		{"dir%2Fx.json.gz", "dir/x.json.gz"},
+	}
+	opts := listOptions{urlEncoding: true}
+	for _, tt := range tests {
+		got, err := opts.decode(tt.raw)
+		if err != nil {
+			t.Fatalf("decode(%q): %v", tt.raw, err)
+		}
+		if got != tt.want {
+			t.Errorf("decode(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+	if got, _ := (listOptions{}).decode("a+b"); got != "a+b" {
+		t.Errorf("decode without -url-encoding = %q, want the key unchanged", got)
+	}
+	if _, err := opts.decode("a%zzb"); err == nil {
+		t.Error("decode of a malformed escape succeeded")
+	}
+}
+
+// listResponse serves a single ListObjectsV2 page of keys, as they would be
+// sent with encoding-type=url when encoded is set.
+func listResponse(t *testing.T, keys []string, encoded bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("encoding-type"); encoded != (got == "url") {
+			t.Errorf("encoding-type = %q", got)
+		}
+		var b strings.Builder
+		b.WriteString(`<?xml version="1.0" encoding="UTF-8"?><ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>bucket</Name><IsTruncated>false</IsTruncated>`)
+		if encoded {
+			b.WriteString(`<EncodingType>url</EncodingType>`)
+		}
+		for _, key := range keys {
+			fmt.Fprintf(&b, `<Contents><Key>%s</Key><Size>1</Size><ETag>"e"</ETag></Contents>`, key)
+		}
+		b.WriteString(`</ListBucketResult>`)
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write([]byte(b.String()))
+	})
+}
+
+func TestCollectRecursiveURLEncodedKeys(t *testing.T) {
+	svc := newStubClient(t, listResponse(t, []string{"logs/a+b.json.gz", "logs/a%20c.json.gz", "logs/a%2Bd.json.gz"}, true))
+	var objects []types.Object
+	collectRecursive(context.Background(), discardLogger(), svc, "bucket", "logs/", listOptions{pageSize: maxListPageSize, urlEncoding: true}, &objects)
+
+	dir := t.TempDir()
+	want := []string{
+		filepath.Join(dir, "logs", "a b.json.gz"),
+		filepath.Join(dir, "logs", "a c.json.gz"),
+		filepath.Join(dir, "logs", "a+d.json.gz"),
+	}
+	if len(objects) != len(want) {
+		t.Fatalf("got %d objects, want %d", len(objects), len(want))
+	}
+	for i, obj := range objects {
+		got, err := targetPath(dir, aws.ToString(obj.Key), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want[i] {
+			t.Errorf("local path of %q = %q, want %q", aws.ToString(obj.Key), got, want[i])
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// listCache is a saved listing in the -list-cache file. Source describes
+// the bucket, prefixes and listing options it was made with; a cache made
+// with anything else is never used.
+type listCache struct {
+	Created time.Time      `json:"created"`
+	Source  string         `json:"source"`
+	Objects []cachedObject `json:"objects"`
+}
+
+type cachedObject struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// listingSource identifies everything that decides what a listing returns.
+func listingSource(opts options) string {
+	prefixes := opts.prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{opts.prefix}
+	}
+	l := opts.list
+	return fmt.Sprintf("endpoint=%q bucket=%q prefixes=%q start-after=%q non-recursive=%t skip-empty=%t include-non-matching=%t url-encoding=%t modified-after=%s min-age=%s",
+		opts.endpoint, opts.bucket, strings.Join(prefixes, ","), l.startAfter, l.nonRecursive, l.skipEmpty, l.includeNonMatching, l.urlEncoding, l.modifiedAfter.Format(time.RFC3339Nano), l.minAge)
+}
+
+// loadListCache returns the cached listing in path if it was made from
+// source and, unless ttl is zero, no more than ttl ago. ok is false when
+// there is no usable cache; why then says what was wrong with it, if
+// anything.
+func loadListCache(path, source string, ttl time.Duration) (objects []types.Object, ok bool, why string, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, "", nil
+	}
+	if err != nil {
+		return nil, false, "", fmt.Errorf("read list cache: %w", err)
+	}
+	var c listCache
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, false, "", fmt.Errorf("parse list cache %s: %w", path, err)
+	}
+	if c.Source != source {
+		return nil, false, "it was made with a different bucket, prefix or listing options", nil
+	}
+	if age := time.Since(c.Created); ttl > 0 && age > ttl {
+		return nil, false, fmt.Sprintf("it is %s old", age.Round(time.Second)), nil
+	}
+
+	objects = make([]types.Object, len(c.Objects))
+	for i, obj := range c.Objects {
+		objects[i] = types.Object{
+			Key:          aws.String(obj.Key),
+			Size:         aws.Int64(obj.Size),
+			ETag:         aws.String(obj.ETag),
+			LastModified: aws.Time(obj.LastModified),
+		}
+	}
+	return objects, true, "", nil
+}
+
+// saveListCache writes objects to path as the listing for source.
+func saveListCache(path, source string, objects []types.Object) error {
+	c := listCache{Created: time.Now(), Source: source, Objects: make([]cachedObject, len(objects))}
+	for i, obj := range objects {
+		c.Objects[i] = cachedObject{
+			Key:          aws.ToString(obj.Key),
+			Size:         aws.ToInt64(obj.Size),
+			ETag:         aws.ToString(obj.ETag),
+			LastModified: aws.ToTime(obj.LastModified),
+		}
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("write list cache: %w", err)
+	}
+	return nil
+}
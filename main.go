@@ -3,161 +3,1674 @@ package main
 import (
 	"compress/gzip"
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strings"
-	"sync"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
-func main() {
-	bucket := "hashfleet-data-lake-prod"
-	localDir := "./downloads/"
-	region := "us-east-2"
+// options is everything run needs for one invocation. parseOptions fills it
+// from flags; tests and other callers can build it directly.
+type options struct {
+	bucket string
+	prefix string
+	// buckets, when set, runs the whole pass once per bucket, each into a
+	// subdirectory of localDir named after it, with its own prefix if one
+	// was given.
+	buckets []bucketTarget
+	// prefixes, when set, replaces prefix with several prefixes listed
+	// concurrently, up to listWorkers at a time.
+	prefixes    []string
+	listWorkers int
+
+	localDir string
+	region   string
+	profile  string
+
+	// credentialsSource forces a single credential provider instead of the
+	// default chain; credentialsTimeout bounds config and credential loading.
+	credentialsSource  string
+	credentialsTimeout time.Duration
+	// sharedCredentialsFile and sharedConfigFile replace the default
+	// ~/.aws/credentials and ~/.aws/config locations.
+	sharedCredentialsFile string
+	sharedConfigFile      string
+	// accessKey, secretKey and sessionToken are static credentials given on
+	// the command line; they replace the credential chain entirely.
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	// maxIdleConnsPerHost sizes the HTTP connection pool; warmConnections
+	// opens that many connections before downloading.
+	maxIdleConnsPerHost int
+	warmConnections     int
+
+	// endpoint and signingRegion target S3-compatible stores. headers are
+	// added to every request, for gateways that want more than SigV4.
+	headers       []requestHeader
+	endpoint      string
+	signingRegion string
+
+	// contentType keeps only objects with this media type, found with one
+	// HeadObject per listed object, headWorkers at a time.
+	contentType string
+	headWorkers int
+
+	// minFreeInodes, when positive, aborts before downloading if fewer
+	// inodes than this would be left on localDir's filesystem.
+	minFreeInodes uint64
+
+	// listCache saves the listing to a file and reuses it while it is
+	// younger than listCacheTTL (0 means any age); refreshCache ignores the
+	// saved listing and replaces it.
+	listCache    string
+	listCacheTTL time.Duration
+	refreshCache bool
+
+	// createEmptyDirs creates a local directory for every folder marker
+	// object found while listing.
+	createEmptyDirs bool
+
+	// continueOnListError skips prefixes that fail to list instead of
+	// failing the run, and reports them once it is done.
+	continueOnListError bool
+
+	// maxListingTime aborts the run if listing alone takes longer.
+	maxListingTime time.Duration
+
+	list       listOptions
+	download   downloadOptions
+	decompress decompressOptions
+
+	// mergeOut, if set, receives the concatenated content of every
+	// downloaded file; orderedMerge writes it in sorted key order.
+	mergeOut     string
+	orderedMerge bool
+	// normalizeNewlines ends each merged file with exactly one newline.
+	normalizeNewlines bool
+	// preserveMtime gives downloaded files their object's LastModified as
+	// modification time.
+	preserveMtime bool
+	// gzipLevel is used for any gzip output the tool produces itself.
+	gzipLevel int
+
+	// writeManifest records every object in place locally; resumeFrom skips
+	// the objects a previous run's manifest already has with the same ETag.
+	writeManifest string
+	resumeFrom    string
+	// manifestChecksums adds size and SHA-256 columns to writeManifest.
+	manifestChecksums bool
+
+	// failuresOut records every object that failed to download. retryFrom
+	// switches to retry mode: the objects in that failures file are fetched
+	// again, instead of listing, for up to retryRounds rounds starting
+	// retryBackoff apart and doubling.
+	failuresOut  string
+	retryFrom    string
+	retryRounds  int
+	retryBackoff time.Duration
+
+	// uploadTo, if set, is an s3:// URL that objects are streamed on to
+	// instead of being written under localDir, through a client for
+	// uploadRegion (default: the source region). uploadDecompress gunzips
+	// them on the way.
+	uploadTo         string
+	uploadRegion     string
+	uploadDecompress bool
+
+	// checksumManifest, if set, receives a sha256sum line for every file
+	// decompressed, with paths relative to localDir.
+	checksumManifest string
+
+	// pipelineWorkers, when positive, decompresses each file as soon as its
+	// download finishes, on that many workers, instead of in a second pass.
+	pipelineWorkers int
+
+	// sizesDepth, when positive, prints a size tree that many levels deep
+	// instead of downloading.
+	sizesDepth int
+	// verifyOnly compares localDir against the listing instead of
+	// downloading; verifyMD5 also checks content against single-part ETags.
+	verifyOnly bool
+	verifyMD5  bool
+	// deleteExtraneous removes local files with no listed object; without
+	// confirmDelete it only previews them.
+	deleteExtraneous bool
+	confirmDelete    bool
+	// deleteAfter removes each object from S3 once it is downloaded.
+	deleteAfter bool
+	// strict fails the run when the listing finds nothing to download.
+	strict bool
+	// printTree prints the local directory as a tree once the run is over,
+	// printTreeDepth levels deep (0 for all).
+	printTree      bool
+	printTreeDepth int
+
+	// stat, if set, is a key or s3://bucket/key whose metadata is printed
+	// instead of running a pass.
+	stat string
+	// dumpConfig, if set, prints the effective configuration as a table or
+	// JSON instead of running a pass.
+	dumpConfig string
+	// listVersions prints every version under the prefix instead of
+	// downloading.
+	listVersions bool
+	// listETags, if set, prints the ETag of every listed object as text or
+	// JSON instead of downloading.
+	listETags string
+	// recoverDeleted lists by version so that keys whose latest version is
+	// a delete marker are downloaded from the version before it.
+	recoverDeleted bool
+	// concurrentList downloads objects as they are listed; see
+	// streamBucket.
+	concurrentList bool
+	// keySpoolDir, if set, holds the keys listed but not yet downloading
+	// in a file there instead of in memory; see keySpool.
+	keySpoolDir string
+	// inventory, if set, is the s3:// URL of an S3 Inventory manifest.json
+	// whose report replaces listing the bucket.
+	inventory string
+	// manifest, if set, is a manifest whose objects are downloaded instead
+	// of listing the bucket; manifestOnly, if set, is where the listing is
+	// written as a manifest instead of downloading it.
+	manifest     string
+	manifestOnly string
+
+	// progressJSON, if set, is where a stream of progress events is written
+	// every progressInterval ("-" for stderr). progressOut is that stream;
+	// run sets it up.
+	progressJSON     string
+	progressInterval time.Duration
+	progressOut      *progressWriter
+
+	// errorSample, when positive, logs the full S3 error of that many failed
+	// downloads; errorSampleFile also writes them there as JSON lines.
+	errorSample     int
+	errorSampleFile string
+
+	// summaryJSON, if set, is where the run summary is written as JSON
+	// ("-" for stdout). summary collects it; run sets it up.
+	summaryJSON string
+	summary     *runSummary
+
+	// stateFile persists run state; sinceLastRun uses its LastModified
+	// watermark to only collect objects newer than the previous run's.
+	stateFile    string
+	sinceLastRun bool
+	// partitionDepth, when positive, only downloads the partitions that
+	// many levels below prefix that the state file hasn't seen yet, and
+	// newPartitions are those to record as seen after this run.
+	partitionDepth int
+	newPartitions  []string
+	// maxObjectSize, when positive, skips every object listed as larger
+	// than that many bytes, with a warning.
+	maxObjectSize int64
+
+	// checkpointInterval and checkpointFiles, when positive, save the
+	// downloads finished so far to the state file that often; see
+	// checkpointer.
+	checkpointInterval time.Duration
+	checkpointFiles    int
 
-	if err := os.MkdirAll(localDir, os.ModePerm); err != nil {
-		log.Fatalf("Failed to create local directory: %v", err)
+	logger *log.Logger
+	// closers are the files parseOptions opened for the run, such as
+	// -log-file, which main closes once it is done.
+	closers []io.Closer
+}
+
+func main() {
+	opts, err := parseOptions(os.Args[1:])
+	if err != nil {
+		var usage usageError
+		switch {
+		case errors.Is(err, flag.ErrHelp):
+			os.Exit(0)
+		case errors.As(err, &usage):
+			// The flag package has already printed it, with the usage.
+			os.Exit(2)
+		}
+		logger := opts.logger
+		if logger == nil {
+			logger = log.New(os.Stderr, "", log.LstdFlags)
+		}
+		logger.Fatalf("%v", err)
+	}
+	for _, c := range opts.closers {
+		defer c.Close()
 	}
 
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(region))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = run(ctx, opts)
+	stop()
 	if err != nil {
-		log.Fatalf("Unable to load SDK config: %v", err)
+		opts.logger.Printf("Error: %v", err)
+		os.Exit(1)
 	}
+}
 
-	svc := s3.NewFromConfig(cfg)
+// usageError is a command line the flag package couldn't parse, which it
+// has already reported.
+type usageError struct{ err error }
 
-	downloader := manager.NewDownloader(svc)
-	var keys []string
-	collectRecursive(svc, bucket, "miner_data/2025/10/20/13", &keys)
-	downloadFiles(context.TODO(), downloader, bucket, localDir, keys)
+func (e usageError) Error() string { return e.err.Error() }
+func (e usageError) Unwrap() error { return e.err }
 
-	log.Println("Decompressing .json.gz files...")
-	if err := decompressGzipFiles(localDir); err != nil {
-		log.Fatalf("Failed to decompress files: %v", err)
+// parseOptions parses args, the command line without the program name, into
+// the options for run, and checks that they fit together. Warnings are
+// logged as it goes.
+func parseOptions(args []string) (options, error) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	var buckets bucketFlag
+	var headers headerFlag
+	fs.Var(&headers, "header", "add this 'Name: Value' header to every S3 request, for gateways that need extra authentication; repeat for several")
+	fs.Var(&buckets, "bucket", "S3 bucket to download from, optionally as bucket:prefix; repeat for several buckets, each written to its own subdirectory of -out (default hashfleet-data-lake-prod)")
+	prefix := fs.String("prefix", "miner_data/2025/10/20/13", "key prefix to list recursively")
+	prefixFile := fs.String("prefix-file", "", "read prefixes to list from this file, one per line ('#' comments allowed), instead of -prefix")
+	listWorkers := fs.Int("list-workers", 8, "with -prefix-file or -parallel-depth, how many prefixes to list at once")
+	parallelDepth := fs.Int("parallel-depth", 0, "list the sub-prefixes this many levels below the prefix concurrently, up to -list-workers at a time, each one serially below that (0 lists everything serially)")
+	localDir := fs.String("out", "./downloads/", "local directory to download into")
+	region := fs.String("region", "", "AWS region (overrides AWS_REGION and the profile's region)")
+	profile := fs.String("profile", "", "shared config profile to use (overrides AWS_PROFILE)")
+	sharedCredentialsFile := fs.String("shared-credentials-file", "", "read the shared credentials file from this path instead of ~/.aws/credentials")
+	sharedConfigFile := fs.String("shared-config-file", "", "read the shared config file from this path instead of ~/.aws/config")
+	credentialsSource := fs.String("credentials-source", "", "use only this credential source: env, profile, ec2 or ecs (default: the SDK's usual chain)")
+	credentialsTimeout := fs.Duration("credentials-timeout", 15*time.Second, "give up if config and credentials can't be loaded within this time (0 waits indefinitely)")
+	accessKey := fs.String("access-key", "", "static AWS access key ID (visible in the process list; prefer AWS_ACCESS_KEY_ID)")
+	secretKey := fs.String("secret-key", "", "static AWS secret access key (visible in the process list; prefer AWS_SECRET_ACCESS_KEY)")
+	sessionToken := fs.String("session-token", "", "optional session token for -access-key/-secret-key")
+	endpoint := fs.String("endpoint", "", "custom S3-compatible endpoint URL, e.g. http://localhost:9000 (uses path-style addressing); {bucket} and {region} are filled in per request, e.g. https://{region}.minio.example.com")
+	signingRegion := fs.String("signing-region", "", "with -endpoint, region to sign requests with, for gateways that check it (defaults to the resolved region)")
+	pageSize := fs.Int("page-size", maxListPageSize, "number of keys to request per ListObjectsV2 page (1-1000)")
+	minAge := fs.Duration("min-age", 0, "skip objects modified less than this long ago, which may still be being written (e.g. 10m; 0 takes everything)")
+	keySpoolDir := fs.String("key-spool-dir", "", "with -concurrent-list-and-download, queue listed keys in a temporary file in this directory instead of in memory, so listings of any size run in bounded memory")
+	concurrentList := fs.Bool("concurrent-list-and-download", false, "start downloading objects as soon as they are listed instead of after the whole listing; options that need the full listing first are refused")
+	continuationToken := fs.String("continuation-token", "", "list from this ListObjectsV2 continuation token, as printed by an earlier -max-files run, instead of from the start of the prefix")
+	maxFiles := fs.Int("max-files", 0, "stop listing once this many files are selected and print the continuation token to resume from (0 lists everything)")
+	startAfter := fs.String("start-after", "", "only list keys that sort after this key (applied at every level of the prefix recursion)")
+	onExisting := fs.String("on-existing", onExistingOverwrite, "what to do when a local file already exists: skip, overwrite or error")
+	caseCollisions := fs.String("case-collisions", caseCollisionRename, "on a case-insensitive filesystem, what to do with keys whose local paths differ only by case: rename (save later ones as name~2.ext, ...) or warn (log and let them overwrite each other)")
+	maxIdleConns := fs.Int("max-idle-conns-per-host", 0, "idle HTTP connections to keep open per host for reuse (default: -max-concurrency, and at least 10)")
+	warmConns := fs.Int("warm-connections", 0, "open this many connections with HEAD requests before downloading, so the first downloads skip the TLS handshake (at most -max-idle-conns-per-host are kept)")
+	minConcurrency := fs.Int("min-concurrency", 20, "concurrent downloads to start with")
+	maxConcurrency := fs.Int("max-concurrency", 20, "upper bound the download concurrency may grow to while requests succeed; throttled requests shrink it back toward -min-concurrency")
+	throttleOnError := fs.Bool("throttle-on-error", false, "when S3 throttles, halve download concurrency even below -min-concurrency (down to 1), then ramp back up as requests succeed")
+	mergeOut := fs.String("merge-out", "", "also concatenate the decompressed content of every downloaded file into this file")
+	orderedMerge := fs.Bool("ordered-merge", false, "write -merge-out in sorted key order instead of completion order")
+	tempDir := fs.String("temp-dir", "", "stage downloads in this directory and move them into -out once complete (e.g. fast local disk when -out is a network mount)")
+	minThroughput := fs.Int64("min-throughput", 0, "abort and retry a download that receives fewer than this many bytes per second over a whole -stall-window (0 disables)")
+	stallWindow := fs.Duration("stall-window", 30*time.Second, "with -min-throughput, how long throughput must stay low before a download counts as stalled")
+	retryBudgetN := fs.Int("retry-budget", 0, "the most download retries to make across the whole run; once spent, failed downloads are not retried any more (0 means no limit beyond -download-retries)")
+	downloadRetries := fs.Int("download-retries", 3, "how many more times to attempt a download that failed in a retryable way, such as a stall")
+	retryBase := fs.Duration("retry-base", defaultBackoff.base, "with -download-retries, the wait before the first retry of a download")
+	retryMax := fs.Duration("retry-max", defaultBackoff.max, "with -download-retries, the longest wait between retries of a download")
+	retryMultiplier := fs.Float64("retry-multiplier", defaultBackoff.multiplier, "with -download-retries, how much longer each wait is than the previous one")
+	retryJitter := fs.String("retry-jitter", defaultBackoff.jitter, "with -download-retries, how to randomize each wait: full (between zero and the wait), equal (between half the wait and all of it) or none")
+	rangeBytes := fs.Int64("range-bytes", 0, "only fetch the first N bytes of each object; gzip output is then incomplete, so decompression is skipped")
+	normalizeNewlines := fs.Bool("normalize-newlines", true, "in -merge-out, end each file's content with exactly one newline so records from adjacent files never run together")
+	gzipLevel := fs.Int("gzip-level", gzip.DefaultCompression, "compression level (1-9) for gzip output, e.g. a -merge-out ending in .gz")
+	outputGzip := fs.Bool("output-gzip", false, "recompress every decompressed file (and -split-records chunk and -merge-out) at -gzip-level and add .gz to its name; a file whose output takes its own name is replaced in place")
+	pretty := fs.Bool("pretty", false, "pretty-print every JSON record while decompressing (NDJSON stays one record after another)")
+	followSymlinks := fs.Bool("follow-symlinks", false, "decompress .gz symlinks found in -out through to their targets (neither the link nor its target is removed); by default they are skipped")
+	force := fs.Bool("force", false, "decompress even if the output file is already newer than its .gz")
+	stateFile := fs.String("state-file", ".s3downloader-state.json", "file that keeps state between runs")
+	onlyNewPartitions := fs.Int("only-new-partitions", 0, "treat the prefixes this many levels below -prefix as partitions (e.g. 4 for YYYY/MM/DD/HH/) and only download those not yet seen by a successful run (tracked in -state-file)")
+	checkpointInterval := fs.Duration("checkpoint-interval", 0, "save the objects downloaded so far to -state-file this often (e.g. 1m), so a rerun after a crash skips them unless their ETag changed; the checkpoint is cleared once a run succeeds")
+	checkpointFiles := fs.Int("checkpoint-files", 0, "also save a checkpoint after every this many downloaded files (see -checkpoint-interval)")
+	sinceLastRun := fs.Bool("since-last-run", false, "only download objects modified after the newest one seen by the last successful run (tracked in -state-file)")
+	stripPrefix := fs.String("strip-prefix", "", "remove this leading part of every key from its local path, e.g. miner_data/2025/10/20/ saves .../13/x.json.gz as 13/x.json.gz under -out; keys without it keep their full path")
+	templateText := fs.String("output-template", "", "local path for each object relative to -out, using {key}, {basename}, {dir}, -output-regex groups like {1} or {name}, and user metadata like {meta:rig-id} (one HEAD request per object)")
+	outputRegex := fs.String("output-regex", "", "regular expression matched against each key; its capture groups can be used in -output-template")
+	dedupe := fs.Bool("dedupe", false, "drop downloaded files whose content is identical to one already downloaded in this run")
+	dedupeLog := fs.String("dedupe-log", "", "with -dedupe, append 'duplicate-key<TAB>original-key' lines to this file")
+	dedupeMax := fs.Int("dedupe-max", 1_000_000, "with -dedupe, how many content hashes to remember; older ones are forgotten first")
+	manifestOnly := fs.String("manifest-only", "", "list the prefix with every filter applied and write the objects to this manifest (key, ETag and size) instead of downloading, for a later -manifest run")
+	manifestIn := fs.String("manifest", "", "download the objects listed in this manifest, as written by -manifest-only, -write-manifest or -failures-out, instead of listing the bucket")
+	writeManifest := fs.String("write-manifest", "", "write a manifest of every object downloaded (key and ETag, tab-separated) to this file")
+	manifestChecksums := fs.Bool("include-checksums-in-manifest", false, "with -write-manifest, also record each object's size and the SHA-256 of its local file, leaving out files whose MD5 doesn't match a plain-MD5 ETag")
+	resumeFrom := fs.String("resume-from", "", "skip objects listed in this manifest from an earlier -write-manifest run, unless their ETag has changed")
+	failuresOut := fs.String("failures-out", "", "write every object that failed to download (key, ETag and error, tab-separated) to this file")
+	retryFrom := fs.String("retry", "", "instead of listing, download the objects in this -failures-out file again, rewriting it with whatever still fails after each round")
+	retryRounds := fs.Int("retry-rounds", 5, "with -retry, the most rounds to attempt before giving up")
+	retryBackoff := fs.Duration("retry-backoff", 30*time.Second, "with -retry, how long to wait before the second round; doubled for every round after")
+	uploadTo := fs.String("upload-to", "", "stream every object on to this s3://bucket/prefix instead of saving it locally")
+	uploadRegion := fs.String("upload-region", "", "with -upload-to, the destination bucket's region (default: the source region)")
+	uploadDecompress := fs.Bool("upload-decompress", false, "with -upload-to, decompress "+matchSuffix+" objects on the way and drop their .gz suffix")
+	checksumManifest := fs.String("checksum-manifest", "", "write the SHA-256 of every decompressed file to this file, in the format 'sha256sum -c' checks (paths relative to -out)")
+	pipeline := fs.Bool("pipeline", false, "decompress each file as soon as it is downloaded instead of after all downloads; only files downloaded in this run are decompressed")
+	decompressMemLimit := fs.Int64("decompress-mem-limit", 0, "with -pipeline, only start another decompression while the estimated decompressed size of those running stays under this many megabytes (0 means no limit)")
+	inPlaceStream := fs.Bool("decompress-in-place-stream", false, "for small disks: fsync every decompressed file before removing its .gz, so at most one file per decompression is ever held twice; slower, since every file waits for the disk")
+	decompressDiskLimit := fs.Int64("decompress-disk-limit", 0, "with -pipeline, only start another decompression while the estimated disk space of those running (each .gz plus its output) stays under this many megabytes (0 means no limit)")
+	decompressDirOut := fs.String("decompress-dir-out", "", "write decompressed files under this directory, mirroring their path below -out, and keep the .gz downloads; by default output goes next to each .gz, which is removed")
+	decompressedSuffix := fs.String("decompressed-suffix", "", "extension to give decompressed files in place of the one left once .gz is removed, e.g. .ndjson turns x.json.gz into x.ndjson")
+	splitRecordsN := fs.Int("split-records", 0, "write each decompressed file as chunks of at most this many NDJSON records, file.part0.json, file.part1.json, ... (0 keeps one file)")
+	transform := fs.String("transform", "", "pipe every decompressed file through this shell command, e.g. 'jq -c .', and write its stdout as the output file; a non-zero exit fails the file")
+	transformWorkers := fs.Int("transform-workers", runtime.NumCPU(), "with -transform, how many transform commands to run at once")
+	maxDecompressErrors := fs.Int("max-decompress-errors", 0, "stop decompressing and fail the run once more than this many files have failed to decompress, which usually means a problem upstream (0 tries every file)")
+	decompressWorkers := fs.Int("decompress-workers", runtime.NumCPU(), "with -pipeline, number of concurrent decompressions")
+	sizes := fs.Bool("sizes", false, "list the prefix and print cumulative sizes per sub-prefix instead of downloading")
+	sizesDepth := fs.Int("sizes-depth", 2, "with -sizes, how many directory levels below the prefix to break the totals down by")
+	verifyOnly := fs.Bool("verify-only", false, "compare the local files against the listing and report missing, extra or mismatched files, without downloading")
+	requireChecksum := fs.Bool("require-checksum", false, "verify every download against the checksum S3 holds for it (a full-object SHA or CRC checksum, or a plain MD5 ETag), and fail objects with neither, such as multipart uploads without a full-object checksum")
+	verifyMD5 := fs.Bool("verify-md5", false, "with -verify-only, also compare each file's MD5 with its ETag where the ETag is a plain MD5")
+	deleteExtra := fs.Bool("delete-extraneous", false, "after listing, delete local files that no listed object maps to (preview only unless -yes is given)")
+	deleteAfter := fs.Bool("delete-after", false, "delete each object from S3 once it has been downloaded, turning the run into a move; objects held by Object Lock are skipped with a warning (requires -yes)")
+	printTree := fs.Bool("print-tree", false, "when the run is over, print the output directory as an indented tree with the size of every file and the total of every directory")
+	printTreeDepth := fs.Int("print-tree-depth", 0, "with -print-tree, how many levels below the output directory to show (0 shows everything)")
+	strict := fs.Bool("strict", false, "fail instead of warning when the listing finds nothing to download")
+	yes := fs.Bool("yes", false, "confirm destructive actions such as -delete-extraneous and -delete-after")
+	listVersions := fs.Bool("list-versions", false, "list every version and delete marker under the prefix (key, version ID, latest, size, last modified) instead of downloading")
+	listETags := fs.String("list-etags", "", "print 'etag  key' for every matching object, sorted by key, as text or json (one object per line) instead of downloading, for diffing two runs")
+	recoverDeleted := fs.Bool("recover-deleted", false, "on a versioned bucket, also download keys whose latest version is a delete marker, from the newest version before it")
+	inventory := fs.String("inventory", "", "take the objects from the S3 Inventory report whose manifest.json is at this s3:// URL instead of listing the bucket (CSV inventories only)")
+	dumpConfigFormat := fs.String("dump-config", "", "print the effective configuration (buckets, region, endpoint, credential source, concurrency, filters; never secrets) as table or json and exit")
+	stat := fs.String("stat", "", "print the size, ETag, storage class and last-modified time of this key (or s3://bucket/key) and exit, downloading nothing; with -summary-json it is written there as JSON")
+	progressJSON := fs.String("progress-json", "", "write a JSON progress event (files and bytes done and total, rate, ETA) every -progress-interval to this file, or - for stderr, for a UI to tail")
+	progressInterval := fs.Duration("progress-interval", 2*time.Second, "with -progress-json, how often to write an event")
+	errorSample := fs.Int("error-sample", 0, "log the full S3 error (HTTP status, error code, message, request and host IDs) of up to this many failed downloads")
+	errorSampleFile := fs.String("error-sample-file", "", "with -error-sample, also write the sampled errors to this file as JSON lines")
+	summaryJSON := fs.String("summary-json", "", "write the run summary (counts, bytes, duration, failures) as one JSON object to this file, or - for stdout")
+	logFile := fs.String("log-file", "", "write logs to this file instead of stderr")
+	logMaxMB := fs.Int("log-max-mb", 0, "rotate -log-file to <file>.1 once it exceeds this many megabytes (0 disables rotation)")
+	nonRecursive := fs.Bool("non-recursive", false, "only take objects directly under -prefix (up to the next '/'), skipping everything in sub-prefixes")
+	urlEncoding := fs.Bool("url-encoding", false, "request URL-encoded keys when listing (EncodingType=url) and decode them locally; use for keys with spaces, '+' or control characters")
+	skipEmpty := fs.Bool("skip-empty", false, "ignore zero-byte objects while listing")
+	maxObjectSize := fs.Int64("max-object-size", 0, "skip, with a warning, every object listed as larger than this many megabytes, to keep one huge object from filling the disk or memory; skipped objects are counted in the summary (0 means no limit)")
+	includeNonMatching := fs.Bool("include-non-matching", false, "download every object under the prefix; only "+matchSuffix+" files are decompressed")
+	lenientDecompress := fs.Bool("lenient-decompress", false, "copy "+matchSuffix+" files that aren't gzip data but look like text (e.g. JSON uploaded uncompressed) through to their output unchanged, with a warning, instead of failing them")
+	forceGzip := fs.Bool("force-gzip", false, "also decompress files that hold gzip data (by their first bytes) whatever their name; those without a .gz suffix are replaced in place. Use with -include-non-matching to download them at all")
+	breakerThreshold := fs.Int("breaker-threshold", 0, "after this many consecutive failed downloads, stop sending requests: fail the rest at once, or with -breaker-cooldown pause and probe (0 disables)")
+	breakerCooldown := fs.Duration("breaker-cooldown", 0, "with -breaker-threshold, pause this long once tripped, then let one download through to test whether the backend recovered")
+	ifModifiedSince := fs.Bool("if-modified-since", false, "when a local copy exists (or its decompressed output), only download the object if S3 has a newer version; unchanged objects are skipped")
+	failFast := fs.Bool("fail-fast", false, "stop all downloads at the first failure and exit non-zero without decompressing, instead of reporting every failure at the end")
+	preserveMtime := fs.Bool("preserve-mtime", false, "set each downloaded file's modification time to the object's LastModified, and carry it over to the decompressed output")
+	compactLogs := fs.Bool("compact-logs", false, "log a running download total every 1000 files or 5 seconds instead of one line per file")
+	verbose := fs.Bool("verbose", false, "enable debug logging, such as every matching key found while listing")
+	contentType := fs.String("content-type", "", "only download objects with this Content-Type, e.g. application/json (costs one HEAD request per listed object)")
+	headWorkers := fs.Int("head-workers", 16, "how many HEAD requests -content-type and {meta:...} template tokens may run at once")
+	minFreeInodes := fs.Uint64("min-free-inodes", 0, "abort before downloading unless this many inodes would still be free on -out's filesystem afterwards (0 only warns when they would run out)")
+	listCache := fs.String("list-cache", "", "save the listing to this file and reuse it on later runs with the same bucket, prefix and listing options")
+	listCacheTTL := fs.Duration("list-cache-ttl", time.Hour, "with -list-cache, re-list once the saved listing is older than this")
+	useCache := fs.Bool("use-cache", false, "with -list-cache, reuse the saved listing however old it is")
+	refreshCache := fs.Bool("refresh-cache", false, "with -list-cache, ignore the saved listing, list again and replace it")
+	createEmptyDirs := fs.Bool("create-empty-dirs", false, "create a local directory for every folder marker object (a key ending in '/'); they are skipped otherwise")
+	continueOnListError := fs.Bool("continue-on-list-error", false, "skip a prefix that fails to list (e.g. access denied) instead of failing the run; skipped prefixes are reported at the end")
+	maxListingTime := fs.Duration("max-listing-time", 0, "abort if listing the prefix takes longer than this, e.g. 10m (0 means no limit)")
+	listProgressEvery := fs.Duration("list-progress", 10*time.Second, "log listing progress at this interval (0 disables)")
+	if err := fs.Parse(args); err != nil {
+		return options{}, usageError{err}
 	}
-}
 
-func collectRecursive(svc *s3.Client, bucket, prefix string, keys *[]string) {
-	input := &s3.ListObjectsV2Input{
-		Bucket:    aws.String(bucket),
-		Prefix:    aws.String(prefix),
-		Delimiter: aws.String("/"),
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	var closers []io.Closer
+	if *logFile != "" {
+		if *logMaxMB < 0 {
+			return options{}, fmt.Errorf("Invalid -log-max-mb %d: must not be negative", *logMaxMB)
+		}
+		out, err := openRotatingFile(*logFile, int64(*logMaxMB)<<20)
+		if err != nil {
+			return options{}, fmt.Errorf("Failed to open log file: %v", err)
+		}
+		closers = append(closers, out)
+		logger.SetOutput(out)
+	}
+	// From here on errors are logged where the run would log them.
+	fail := func(format string, args ...any) (options, error) {
+		return options{logger: logger}, fmt.Errorf(format, args...)
+	}
+
+	if len(buckets) == 0 {
+		buckets = bucketFlag{{bucket: "hashfleet-data-lake-prod"}}
+	}
+	switch *dumpConfigFormat {
+	case "", dumpConfigTable, dumpConfigJSON:
+	default:
+		return fail("Invalid -dump-config %q: must be table or json", *dumpConfigFormat)
+	}
+	switch *listETags {
+	case "", listETagsText, listETagsJSON:
+	default:
+		return fail("Invalid -list-etags %q: must be text or json", *listETags)
+	}
+	// The dump identifies objects by key alone and needs the whole listing.
+	if *listETags != "" && (len(buckets) > 1 || *retryFrom != "" || *concurrentList) {
+		return fail("-list-etags cannot be combined with several -bucket values, -retry or -concurrent-list-and-download")
+	}
+	if *stat != "" && len(buckets) > 1 {
+		return fail("-stat looks up a single object; give its bucket with one -bucket or as s3://bucket/key")
+	}
+	// These all describe a single bucket's objects by key alone.
+	if len(buckets) > 1 && (*mergeOut != "" || *writeManifest != "" || *resumeFrom != "" || *failuresOut != "" || *retryFrom != "" || *sinceLastRun || *listCache != "") {
+		return fail("several -bucket values cannot be combined with -merge-out, -write-manifest, -resume-from, -failures-out, -retry, -since-last-run or -list-cache")
+	}
+	if *maxObjectSize < 0 {
+		return fail("Invalid -max-object-size %d: must not be negative", *maxObjectSize)
+	}
+	// Skipped objects would look missing or extraneous locally.
+	if *maxObjectSize > 0 && (*verifyOnly || *deleteExtra) {
+		return fail("-max-object-size cannot be combined with -verify-only or -delete-extraneous")
+	}
+	if *checkpointInterval < 0 {
+		return fail("Invalid -checkpoint-interval %s: must not be negative", *checkpointInterval)
+	}
+	if *checkpointFiles < 0 {
+		return fail("Invalid -checkpoint-files %d: must not be negative", *checkpointFiles)
+	}
+	// The checkpoint records one bucket's objects, and a merged output
+	// rewritten by the rerun would lack the ones it skips.
+	if (*checkpointInterval > 0 || *checkpointFiles > 0) && (len(buckets) > 1 || *retryFrom != "" || *mergeOut != "") {
+		return fail("-checkpoint-interval and -checkpoint-files cannot be combined with several -bucket values, -retry or -merge-out")
 	}
 
-	paginator := s3.NewListObjectsV2Paginator(svc, input)
-	for paginator.HasMorePages() {
-		page, err := paginator.NextPage(context.TODO())
+	if *pageSize < 1 || *pageSize > maxListPageSize {
+		return fail("Invalid -page-size %d: must be between 1 and %d", *pageSize, maxListPageSize)
+	}
+	switch *onExisting {
+	case onExistingSkip, onExistingOverwrite, onExistingError:
+	default:
+		return fail("Invalid -on-existing %q: must be skip, overwrite or error", *onExisting)
+	}
+	switch *caseCollisions {
+	case caseCollisionRename, caseCollisionWarn:
+	default:
+		return fail("Invalid -case-collisions %q: must be rename or warn", *caseCollisions)
+	}
+	if *orderedMerge && *mergeOut == "" {
+		return fail("-ordered-merge requires -merge-out")
+	}
+	if *gzipLevel != gzip.DefaultCompression && (*gzipLevel < gzip.BestSpeed || *gzipLevel > gzip.BestCompression) {
+		return fail("Invalid -gzip-level %d: must be between %d and %d", *gzipLevel, gzip.BestSpeed, gzip.BestCompression)
+	}
+	if *minThroughput < 0 {
+		return fail("Invalid -min-throughput %d: must not be negative", *minThroughput)
+	}
+	if *minThroughput > 0 && *stallWindow <= 0 {
+		return fail("Invalid -stall-window %s: must be positive", *stallWindow)
+	}
+	if *breakerThreshold < 0 || *breakerCooldown < 0 {
+		return fail("Invalid circuit breaker settings: -breaker-threshold and -breaker-cooldown must not be negative")
+	}
+	if *downloadRetries < 0 {
+		return fail("Invalid -download-retries %d: must not be negative", *downloadRetries)
+	}
+	if *retryBudgetN < 0 {
+		return fail("Invalid -retry-budget %d: must not be negative", *retryBudgetN)
+	}
+	retryBackoffSchedule := backoff{
+		base:       *retryBase,
+		max:        *retryMax,
+		multiplier: *retryMultiplier,
+		jitter:     *retryJitter,
+	}
+	if err := retryBackoffSchedule.validate(); err != nil {
+		return fail("Invalid retry schedule: %v", err)
+	}
+	if *rangeBytes < 0 {
+		return fail("Invalid -range-bytes %d: must not be negative", *rangeBytes)
+	}
+	if *rangeBytes > 0 && *mergeOut != "" {
+		return fail("-range-bytes cannot be combined with -merge-out: partial gzip streams can't be decompressed")
+	}
+	if *rangeBytes > 0 && *checksumManifest != "" {
+		return fail("-checksum-manifest cannot be combined with -range-bytes, which skips decompression")
+	}
+	var tmpl *outputTemplate
+	if *templateText != "" {
+		var err error
+		if tmpl, err = parseOutputTemplate(*templateText, *outputRegex); err != nil {
+			return fail("%w", err)
+		}
+	} else if *outputRegex != "" {
+		return fail("-output-regex requires -output-template")
+	}
+	if *stripPrefix != "" {
+		if *templateText != "" || *uploadTo != "" {
+			return fail("-strip-prefix cannot be combined with -output-template or -upload-to")
+		}
+		// A strip prefix unrelated to the listed one matches no key, which
+		// is most likely a typo.
+		p := *prefix
+		if len(buckets) == 1 && buckets[0].prefix != "" {
+			p = buckets[0].prefix
+		}
+		if *prefixFile == "" && !strings.HasPrefix(*stripPrefix, p) && !strings.HasPrefix(p, *stripPrefix) {
+			logger.Printf("Warning: -strip-prefix %q and -prefix %q don't overlap; keys that don't start with it keep their full path", *stripPrefix, p)
+		}
+		tmpl = stripPrefixTemplate(*stripPrefix)
+	}
+	if *dedupe && *dedupeMax < 1 {
+		return fail("Invalid -dedupe-max %d: must be at least 1", *dedupeMax)
+	}
+	if *pipeline {
+		if *decompressWorkers < 1 {
+			return fail("Invalid -decompress-workers %d: must be at least 1", *decompressWorkers)
+		}
+		if *orderedMerge || *rangeBytes > 0 {
+			return fail("-pipeline cannot be combined with -ordered-merge or -range-bytes")
+		}
+		if *decompressMemLimit < 0 {
+			return fail("Invalid -decompress-mem-limit %d: must not be negative", *decompressMemLimit)
+		}
+		if *decompressDiskLimit < 0 {
+			return fail("Invalid -decompress-disk-limit %d: must not be negative", *decompressDiskLimit)
+		}
+	} else if *decompressMemLimit != 0 || *decompressDiskLimit != 0 {
+		return fail("-decompress-mem-limit and -decompress-disk-limit require -pipeline")
+	}
+	// The .gz files are kept there, so there is no peak to lower.
+	if *inPlaceStream && *decompressDirOut != "" {
+		return fail("-decompress-in-place-stream cannot be combined with -decompress-dir-out")
+	}
+	if *retryFrom != "" {
+		if *retryRounds < 1 {
+			return fail("Invalid -retry-rounds %d: must be at least 1", *retryRounds)
+		}
+		if *retryBackoff < 0 {
+			return fail("Invalid -retry-backoff %s: must not be negative", *retryBackoff)
+		}
+		// -retry downloads a fixed set of keys without listing, so nothing
+		// that works from the listing applies.
+		if *failuresOut != "" || *mergeOut != "" || *writeManifest != "" || *pipeline || *sizes || *verifyOnly || *deleteExtra || *sinceLastRun {
+			return fail("-retry cannot be combined with -failures-out, -merge-out, -write-manifest, -pipeline, -sizes, -verify-only, -delete-extraneous or -since-last-run")
+		}
+	}
+	if *listCache == "" && (*useCache || *refreshCache) {
+		return fail("-use-cache and -refresh-cache require -list-cache")
+	}
+	if *useCache && *refreshCache {
+		return fail("-use-cache and -refresh-cache cannot be combined")
+	}
+	if *listCacheTTL < 0 {
+		return fail("Invalid -list-cache-ttl %s: must not be negative", *listCacheTTL)
+	}
+	if *uploadTo != "" {
+		if _, _, err := parseS3URL(*uploadTo); err != nil {
+			return fail("Invalid -upload-to: %v", err)
+		}
+		// Nothing is written locally, so none of these have anything to
+		// work on.
+		if *mergeOut != "" || *pipeline || *dedupe || *checksumManifest != "" || *templateText != "" || *ifModifiedSince || *verifyOnly || *deleteExtra || *retryFrom != "" {
+			return fail("-upload-to cannot be combined with -merge-out, -pipeline, -dedupe, -checksum-manifest, -output-template, -if-modified-since, -verify-only, -delete-extraneous or -retry")
+		}
+		if *preserveMtime {
+			return fail("-preserve-mtime cannot be combined with -upload-to: nothing is written locally")
+		}
+		if *uploadDecompress && *rangeBytes > 0 {
+			return fail("-upload-decompress cannot be combined with -range-bytes: partial gzip streams can't be decompressed")
+		}
+	} else if *uploadRegion != "" || *uploadDecompress {
+		return fail("-upload-region and -upload-decompress require -upload-to")
+	}
+	if *deleteAfter {
+		if !*yes {
+			return fail("-delete-after deletes objects from S3; pass -yes to confirm")
+		}
+		// Each of these leaves the local copy incomplete, possibly stale,
+		// or not written at all.
+		if *rangeBytes > 0 || *onExisting == onExistingSkip || *sizes || *verifyOnly {
+			return fail("-delete-after cannot be combined with -range-bytes, -on-existing=skip, -sizes or -verify-only")
+		}
+	}
+	// The version listing bypasses the usual listing, and neither the
+	// failures file nor the passthrough carries version IDs.
+	if *recoverDeleted && (*sinceLastRun || *listCache != "" || *uploadTo != "" || *retryFrom != "" || *deleteAfter || *minAge > 0) {
+		return fail("-recover-deleted cannot be combined with -since-last-run, -list-cache, -upload-to, -retry, -delete-after or -min-age")
+	}
+	if s := *decompressedSuffix; s != "" && (len(s) < 2 || s[0] != '.' || strings.ContainsAny(s, `/\`) || strings.HasSuffix(s, ".gz")) {
+		return fail("Invalid -decompressed-suffix %q: must be an extension such as .ndjson, not end in .gz and contain no path separators", s)
+	}
+	if *splitRecordsN < 0 {
+		return fail("Invalid -split-records %d: must not be negative", *splitRecordsN)
+	}
+	// Pretty-printed records span lines, and the chunks aren't among the
+	// outputs -delete-extraneous expects.
+	if *splitRecordsN > 0 && (*pretty || *deleteExtra) {
+		return fail("-split-records cannot be combined with -pretty or -delete-extraneous")
+	}
+	// Recompressed outputs are neither the downloads -verify-only sizes
+	// up nor among the outputs -delete-extraneous expects.
+	if *outputGzip && (*verifyOnly || *deleteExtra || *uploadTo != "") {
+		return fail("-output-gzip cannot be combined with -verify-only, -delete-extraneous or -upload-to")
+	}
+	if *outputGzip && *mergeOut != "" && !strings.HasSuffix(*mergeOut, ".gz") {
+		*mergeOut += ".gz"
+		logger.Printf("With -output-gzip, writing the merged output to %s", *mergeOut)
+	}
+	if *printTreeDepth < 0 {
+		return fail("Invalid -print-tree-depth %d: must not be negative", *printTreeDepth)
+	}
+	if *printTree && *uploadTo != "" {
+		return fail("-print-tree cannot be combined with -upload-to, which writes nothing locally")
+	}
+	// Neither a partial object nor a copy streamed elsewhere is hashed.
+	if *requireChecksum && (*rangeBytes > 0 || *uploadTo != "") {
+		return fail("-require-checksum cannot be combined with -range-bytes or -upload-to")
+	}
+	if *transformWorkers < 1 {
+		return fail("Invalid -transform-workers %d: must be at least 1", *transformWorkers)
+	}
+	// The transform replaces the decompressed content that the others
+	// rewrite or write elsewhere.
+	if *transform != "" && (*pretty || *splitRecordsN > 0 || *mergeOut != "" || *uploadTo != "") {
+		return fail("-transform cannot be combined with -pretty, -split-records, -merge-out or -upload-to")
+	}
+	if *inventory != "" {
+		if !strings.HasPrefix(*inventory, "s3://") {
+			return fail("Invalid -inventory %q: must be an s3:// URL of a manifest.json", *inventory)
+		}
+		// An inventory is of one bucket, and a snapshot that can be a day or
+		// more old, so anything written since would look extraneous.
+		if len(buckets) > 1 || *recoverDeleted || *listCache != "" || *continuationToken != "" || *maxFiles > 0 || *deleteExtra {
+			return fail("-inventory cannot be combined with several -bucket flags, -recover-deleted, -list-cache, -continuation-token, -max-files or -delete-extraneous")
+		}
+	}
+	if *manifestOnly != "" && (len(buckets) > 1 || *retryFrom != "" || *concurrentList || *deleteExtra || *manifestIn != "") {
+		return fail("-manifest-only cannot be combined with several -bucket flags, -retry, -concurrent-list-and-download, -delete-extraneous or -manifest")
+	}
+	// The manifest replaces the listing, along with everything that only
+	// applies to one.
+	if *manifestIn != "" && (len(buckets) > 1 || *prefixFile != "" || *inventory != "" || *recoverDeleted || *listCache != "" || *continuationToken != "" || *maxFiles > 0 ||
+		*sinceLastRun || *onlyNewPartitions > 0 || *retryFrom != "" || *concurrentList || *deleteExtra) {
+		return fail("-manifest cannot be combined with several -bucket flags, -prefix-file, -inventory, -recover-deleted, -list-cache, -continuation-token, -max-files, -since-last-run, -only-new-partitions, -retry, -concurrent-list-and-download or -delete-extraneous")
+	}
+	if *keySpoolDir != "" {
+		if !*concurrentList {
+			return fail("-key-spool-dir requires -concurrent-list-and-download")
+		}
+		// Telling overlapping prefixes' keys apart means keeping them all.
+		if *prefixFile != "" {
+			return fail("-key-spool-dir cannot be combined with -prefix-file")
+		}
+		if info, err := os.Stat(*keySpoolDir); err != nil || !info.IsDir() {
+			return fail("Invalid -key-spool-dir %q: must be an existing directory", *keySpoolDir)
+		}
+	}
+	// These all need the whole listing before the first download.
+	if *concurrentList && (*maxFiles > 0 || *continuationToken != "" || *listCache != "" || *recoverDeleted || *inventory != "" || *retryFrom != "" ||
+		*sizes || *verifyOnly || *deleteExtra || *resumeFrom != "" || *contentType != "" || *onExisting == onExistingError || *minFreeInodes > 0 ||
+		*mergeOut != "" || *writeManifest != "" || *failuresOut != "" || *progressJSON != "" || *preserveMtime || *checkpointInterval > 0 || *checkpointFiles > 0) {
+		return fail("-concurrent-list-and-download cannot be combined with -max-files, -continuation-token, -list-cache, -recover-deleted, -inventory, -retry, -sizes, -verify-only, -delete-extraneous, -resume-from, -content-type, -on-existing=error, -min-free-inodes, -merge-out, -write-manifest, -failures-out, -progress-json, -preserve-mtime or -checkpoint-interval, which need the whole listing first")
+	}
+	if *errorSample < 0 {
+		return fail("Invalid -error-sample %d: must not be negative", *errorSample)
+	}
+	if *errorSampleFile != "" && *errorSample == 0 {
+		return fail("-error-sample-file requires -error-sample")
+	}
+	if *maxIdleConns < 0 {
+		return fail("Invalid -max-idle-conns-per-host %d: must not be negative", *maxIdleConns)
+	}
+	if *maxIdleConns == 0 {
+		*maxIdleConns = max(*maxConcurrency, defaultIdleConnsPerHost)
+	}
+	if *warmConns < 0 {
+		return fail("Invalid -warm-connections %d: must not be negative", *warmConns)
+	}
+	if *warmConns > *maxIdleConns {
+		logger.Printf("Warning: only %d of the -warm-connections %d can stay idle; raise -max-idle-conns-per-host to keep them all", *maxIdleConns, *warmConns)
+	}
+	if *onlyNewPartitions < 0 {
+		return fail("Invalid -only-new-partitions %d: must not be negative", *onlyNewPartitions)
+	}
+	// The partitions replace -prefix with prefixes of their own, and
+	// everything in partitions already seen would look extraneous.
+	if *onlyNewPartitions > 0 && (*prefixFile != "" || *continuationToken != "" || *maxFiles > 0 || *inventory != "" || *deleteExtra || *retryFrom != "") {
+		return fail("-only-new-partitions cannot be combined with -prefix-file, -continuation-token, -max-files, -inventory, -delete-extraneous or -retry")
+	}
+	if *maxDecompressErrors < 0 {
+		return fail("Invalid -max-decompress-errors %d: must not be negative", *maxDecompressErrors)
+	}
+	if *progressJSON != "" && *progressInterval <= 0 {
+		return fail("Invalid -progress-interval %s: must be positive", *progressInterval)
+	}
+	if *manifestChecksums && *writeManifest == "" {
+		return fail("-include-checksums-in-manifest requires -write-manifest")
+	}
+	if *endpoint != "" {
+		if err := validateEndpoint(*endpoint); err != nil {
+			return fail("Invalid -endpoint: %v", err)
+		}
+	} else if *signingRegion != "" {
+		// Against AWS it would send every request to that region's
+		// endpoint instead.
+		return fail("-signing-region requires -endpoint")
+	}
+	if *sizes && *sizesDepth < 1 {
+		return fail("Invalid -sizes-depth %d: must be at least 1", *sizesDepth)
+	}
+	// Anything the listing leaves out would look extraneous, so refuse the
+	// options that deliberately list only part of the prefix.
+	if *deleteExtra && (*sinceLastRun || *startAfter != "") {
+		return fail("-delete-extraneous cannot be combined with -since-last-run or -start-after, which only list part of the prefix")
+	}
+	if *verifyMD5 && !*verifyOnly {
+		return fail("-verify-md5 requires -verify-only")
+	}
+	switch *credentialsSource {
+	case "", credSourceEnv, credSourceProfile, credSourceEC2, credSourceECS:
+	default:
+		return fail("Invalid -credentials-source %q: must be env, profile, ec2 or ecs", *credentialsSource)
+	}
+	for name, path := range map[string]string{"-shared-credentials-file": *sharedCredentialsFile, "-shared-config-file": *sharedConfigFile} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err != nil {
+			return fail("Invalid %s: %v", name, err)
+		} else if info.IsDir() {
+			return fail("Invalid %s: %s is a directory", name, path)
+		}
+	}
+	if (*accessKey == "") != (*secretKey == "") || (*sessionToken != "" && *accessKey == "") {
+		return fail("-access-key and -secret-key must be given together (and -session-token only with them)")
+	}
+	if *accessKey != "" {
+		if *credentialsSource != "" {
+			return fail("-access-key cannot be combined with -credentials-source")
+		}
+		logger.Printf("Warning: secrets passed as flags can be read from the process list and shell history; prefer AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY with -credentials-source=env")
+	}
+	if *headWorkers < 1 {
+		return fail("Invalid -head-workers %d: must be at least 1", *headWorkers)
+	}
+	if *parallelDepth < 0 {
+		return fail("Invalid -parallel-depth %d: must not be negative", *parallelDepth)
+	}
+	if *minAge < 0 {
+		return fail("Invalid -min-age %s: must not be negative", *minAge)
+	}
+	if *maxFiles < 0 {
+		return fail("Invalid -max-files %d: must not be negative", *maxFiles)
+	}
+	// A continuation token belongs to one flat listing of one prefix.
+	if *continuationToken != "" || *maxFiles > 0 {
+		if len(buckets) > 1 || *prefixFile != "" || *parallelDepth > 0 || *nonRecursive {
+			return fail("-continuation-token and -max-files list a single prefix of a single bucket, and cannot be combined with -prefix-file, -parallel-depth or -non-recursive")
+		}
+		if *continuationToken != "" && *startAfter != "" {
+			return fail("-continuation-token cannot be combined with -start-after, which S3 ignores once a token is given")
+		}
+		if *deleteExtra || *sinceLastRun || *listCache != "" || *recoverDeleted {
+			return fail("-continuation-token and -max-files list only part of the prefix, and cannot be combined with -delete-extraneous, -since-last-run, -list-cache or -recover-deleted")
+		}
+	}
+	if *listWorkers < 1 {
+		return fail("Invalid -list-workers %d: must be at least 1", *listWorkers)
+	}
+	if *minConcurrency < 1 || *maxConcurrency < *minConcurrency {
+		return fail("Invalid concurrency bounds: need 1 <= -min-concurrency (%d) <= -max-concurrency (%d)", *minConcurrency, *maxConcurrency)
+	}
+
+	opts := options{
+		bucket:   buckets[0].bucket,
+		prefix:   *prefix,
+		localDir: *localDir,
+		region:   *region,
+		profile:  *profile,
+
+		credentialsSource:  *credentialsSource,
+		credentialsTimeout: *credentialsTimeout,
+		accessKey:          *accessKey,
+		secretKey:          *secretKey,
+		sessionToken:       *sessionToken,
+
+		sharedCredentialsFile: *sharedCredentialsFile,
+		sharedConfigFile:      *sharedConfigFile,
+
+		endpoint:      *endpoint,
+		headers:       headers,
+		signingRegion: *signingRegion,
+
+		maxIdleConnsPerHost: *maxIdleConns,
+		warmConnections:     *warmConns,
+
+		contentType: mediaType(*contentType),
+		headWorkers: *headWorkers,
+
+		listCache:    *listCache,
+		listCacheTTL: *listCacheTTL,
+		refreshCache: *refreshCache,
+
+		createEmptyDirs:     *createEmptyDirs,
+		continueOnListError: *continueOnListError,
+
+		maxListingTime: *maxListingTime,
+		minFreeInodes:  *minFreeInodes,
+
+		list: listOptions{
+			pageSize:           int32(*pageSize),
+			startAfter:         *startAfter,
+			skipEmpty:          *skipEmpty,
+			includeNonMatching: *includeNonMatching,
+			nonRecursive:       *nonRecursive,
+			urlEncoding:        *urlEncoding,
+			verbose:            *verbose,
+			parallelDepth:      *parallelDepth,
+			workers:            *listWorkers,
+			continuationToken:  *continuationToken,
+			maxFiles:           *maxFiles,
+			minAge:             *minAge,
+		},
+		download: downloadOptions{
+			onExisting:      *onExisting,
+			caseCollisions:  *caseCollisions,
+			minConcurrency:  *minConcurrency,
+			maxConcurrency:  *maxConcurrency,
+			throttleOnError: *throttleOnError,
+			rangeBytes:      *rangeBytes,
+			template:        tmpl,
+			tempDir:         *tempDir,
+			minThroughput:   *minThroughput,
+			stallWindow:     *stallWindow,
+			retries:         *downloadRetries,
+			retryBudget:     newRetryBudget(*retryBudgetN),
+			backoff:         retryBackoffSchedule,
+			failFast:        *failFast,
+			ifModifiedSince: *ifModifiedSince,
+			compactLogs:     *compactLogs,
+
+			breakerThreshold: *breakerThreshold,
+			breakerCooldown:  *breakerCooldown,
+
+			requireChecksum: *requireChecksum,
+		},
+		decompress: decompressOptions{
+			force:          *force,
+			verbose:        *verbose,
+			pretty:         *pretty,
+			followSymlinks: *followSymlinks,
+			preserveMtime:  *preserveMtime,
+			forceGzip:      *forceGzip,
+			lenient:        *lenientDecompress,
+			outputGzip:     *outputGzip,
+			gzipLevel:      *gzipLevel,
+			maxErrors:      *maxDecompressErrors,
+			outDir:         *decompressDirOut,
+			memLimit:       *decompressMemLimit << 20,
+			diskLimit:      *decompressDiskLimit << 20,
+			syncOutput:     *inPlaceStream,
+			splitRecords:   *splitRecordsN,
+			suffix:         *decompressedSuffix,
+		},
+		mergeOut:     *mergeOut,
+		orderedMerge: *orderedMerge,
+		gzipLevel:    *gzipLevel,
+
+		normalizeNewlines: *normalizeNewlines,
+		preserveMtime:     *preserveMtime,
+
+		writeManifest:     *writeManifest,
+		manifestChecksums: *manifestChecksums,
+		resumeFrom:        *resumeFrom,
+
+		failuresOut:  *failuresOut,
+		retryFrom:    *retryFrom,
+		retryRounds:  *retryRounds,
+		retryBackoff: *retryBackoff,
+
+		uploadTo:         *uploadTo,
+		uploadRegion:     *uploadRegion,
+		uploadDecompress: *uploadDecompress,
+
+		checksumManifest: *checksumManifest,
+
+		verifyOnly: *verifyOnly,
+		verifyMD5:  *verifyMD5,
+
+		deleteExtraneous: *deleteExtra,
+		confirmDelete:    *yes,
+		deleteAfter:      *deleteAfter,
+		strict:           *strict,
+		printTree:        *printTree,
+		printTreeDepth:   *printTreeDepth,
+
+		summaryJSON:      *summaryJSON,
+		errorSample:      *errorSample,
+		errorSampleFile:  *errorSampleFile,
+		stat:             *stat,
+		dumpConfig:       *dumpConfigFormat,
+		progressJSON:     *progressJSON,
+		progressInterval: *progressInterval,
+		listVersions:     *listVersions,
+		listETags:        *listETags,
+		recoverDeleted:   *recoverDeleted,
+		inventory:        *inventory,
+		manifest:         *manifestIn,
+		manifestOnly:     *manifestOnly,
+		concurrentList:   *concurrentList,
+		keySpoolDir:      *keySpoolDir,
+
+		stateFile:    *stateFile,
+		sinceLastRun: *sinceLastRun,
+
+		partitionDepth: *onlyNewPartitions,
+
+		maxObjectSize: *maxObjectSize << 20,
+
+		checkpointInterval: *checkpointInterval,
+		checkpointFiles:    *checkpointFiles,
+
+		logger:  logger,
+		closers: closers,
+	}
+	if *useCache {
+		opts.listCacheTTL = 0
+	}
+	if *dedupe {
+		var mapping io.Writer
+		if *dedupeLog != "" {
+			f, err := os.OpenFile(*dedupeLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+			if err != nil {
+				return fail("Failed to open dedupe log: %v", err)
+			}
+			closers = append(closers, f)
+			mapping = f
+		}
+		opts.download.dedupe = newDedupeIndex(*dedupeMax, mapping)
+	}
+	if *sizes {
+		opts.sizesDepth = *sizesDepth
+	}
+	if *pipeline {
+		opts.pipelineWorkers = *decompressWorkers
+	}
+	if *transform != "" {
+		opts.decompress.transform = newTransformCommand(*transform, *transformWorkers)
+	}
+	if *prefixFile != "" {
+		prefixes, err := readPrefixFile(*prefixFile)
 		if err != nil {
-			log.Printf("Error listing %s: %v", prefix, err)
-			return
+			return fail("%w", err)
 		}
+		opts.prefixes = prefixes
+		opts.listWorkers = *listWorkers
+	}
+	if len(buckets) > 1 {
+		opts.buckets = buckets
+	} else if buckets[0].prefix != "" {
+		opts.prefix = buckets[0].prefix
+		opts.prefixes = nil
+	}
+	if *listProgressEvery > 0 {
+		opts.list.progress = newListProgress(*listProgressEvery)
+	}
 
-		for _, cp := range page.CommonPrefixes {
-			collectRecursive(svc, bucket, *cp.Prefix, keys)
+	if !opts.reportOnly() {
+		// Listing, HEAD requests and pipelined decompression hold
+		// descriptors of their own.
+		other := opts.list.workers + opts.headWorkers + 2*opts.pipelineWorkers
+		minC, maxC, err := fitOpenFiles(logger, opts.download.minConcurrency, opts.download.maxConcurrency, other)
+		if err != nil {
+			return fail("%w", err)
 		}
+		opts.download.minConcurrency, opts.download.maxConcurrency = minC, maxC
+	}
+	return opts, nil
+}
+
+// sizesPrefix is the prefix -sizes groups below. With several prefixes
+// there is no single one, so grouping starts at the bucket root.
+func (o options) sizesPrefix() string {
+	if len(o.prefixes) > 0 {
+		return ""
+	}
+	return o.prefix
+}
+
+// reportOnly reports whether opts only prints information, downloading
+// nothing.
+func (o options) reportOnly() bool {
+	return o.sizesDepth > 0 || o.verifyOnly || o.stat != "" || o.listVersions || o.dumpConfig != "" || o.listETags != "" || o.manifestOnly != ""
+}
 
-		for _, obj := range page.Contents {
-			if strings.HasSuffix(*obj.Key, ".json.gz") {
-				*keys = append(*keys, *obj.Key)
+// checkpointing reports whether opts saves checkpoints as it downloads.
+func (o options) checkpointing() bool {
+	return o.checkpointInterval > 0 || o.checkpointFiles > 0
+}
+
+// run performs a full list, download and decompress pass, once per bucket
+// when several are given.
+func run(ctx context.Context, opts options) (err error) {
+	logger := opts.logger
 
-				fmt.Println("Found file:", *obj.Key) // Debug print
+	opts.summary = newRunSummary()
+	if opts.keySpoolDir != "" {
+		opts.summary = newCompactSummary()
+	}
+	opts.summary.retries = opts.download.retryBudget
+	defer func() {
+		// -stat and -dump-config report on their own.
+		if opts.stat != "" || opts.dumpConfig != "" {
+			return
+		}
+		report := opts.summary.report(err)
+		if !opts.reportOnly() {
+			logSummary(logger, report)
+		}
+		if opts.summaryJSON != "" {
+			if werr := writeSummaryJSON(opts.summaryJSON, report); werr != nil {
+				err = errors.Join(err, werr)
 			}
 		}
+	}()
+
+	if opts.download.tempDir != "" {
+		if err := os.MkdirAll(opts.download.tempDir, os.ModePerm); err != nil {
+			return fmt.Errorf("create temp directory: %w", err)
+		}
+	}
+
+	cfg, err := loadAWSConfig(ctx, opts)
+	if err != nil {
+		return err
+	}
+	logger.Printf("Using region %s", cfg.Region)
+
+	// Long runs can outlive credentials the SDK doesn't refresh itself.
+	creds := newRefreshableCredentials(cfg.Credentials, func(ctx context.Context) (aws.CredentialsProvider, error) {
+		fresh, err := loadAWSConfig(ctx, opts)
+		return fresh.Credentials, err
+	})
+	cfg.Credentials = creds.cache
+	opts.download.credentials = creds
+
+	svc := newS3Client(cfg, opts)
+
+	// Buckets of a multi-bucket run can be anywhere; a custom endpoint
+	// has no regions to look up, unless it routes by {region}.
+	var regions *regionClients
+	if len(opts.buckets) > 0 && (opts.endpoint == "" || strings.Contains(opts.endpoint, endpointRegionToken)) {
+		regions = newRegionClients(cfg, opts, svc)
+		names := make([]string, len(opts.buckets))
+		for i, t := range opts.buckets {
+			names[i] = t.bucket
+		}
+		regions.resolve(ctx, logger, names, opts.list.workers)
+	}
+
+	if opts.dumpConfig != "" {
+		return dumpConfig(ctx, os.Stdout, cfg, opts, regions)
+	}
+	if opts.stat != "" {
+		return statObject(ctx, svc, opts)
+	}
+
+	if opts.uploadTo != "" {
+		dstCfg := cfg.Copy()
+		if opts.uploadRegion != "" {
+			dstCfg.Region = opts.uploadRegion
+		}
+		upload, err := newPassthrough(newS3Client(dstCfg, opts), opts.uploadTo, opts.uploadDecompress)
+		if err != nil {
+			return err
+		}
+		opts.download.upload = upload
+		logger.Printf("Copying objects to %s instead of saving them locally", opts.uploadTo)
+	}
+
+	if opts.progressJSON == "-" {
+		opts.progressOut = &progressWriter{w: os.Stderr}
+	} else if opts.progressJSON != "" {
+		f, err := os.Create(opts.progressJSON)
+		if err != nil {
+			return fmt.Errorf("create progress file: %w", err)
+		}
+		defer f.Close()
+		opts.progressOut = &progressWriter{w: f}
 	}
-}
 
-func downloadFiles(ctx context.Context, downloader *manager.Downloader, bucket, localDir string, keys []string) {
-	var wg sync.WaitGroup
-	sem := make(chan struct{}, 20) // Limit concurrent downloads to 20
-
-	for _, key := range keys {
-		wg.Add(1)
-		go func(key string) {
-			defer wg.Done()
-			sem <- struct{}{}
-			defer func() { <-sem }()
-
-			// Mirror the S3 key structure locally
-			filePath := filepath.Join(localDir, key)
-			if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
-				log.Printf("Failed to create dir for %s: %v", key, err)
-				return
+	// Share one limiter, so a limit learned against one bucket carries over
+	// to the next.
+	opts.download.limiter = opts.download.newLimiter(logger)
+
+	if opts.errorSample > 0 {
+		sampler := newErrorSampler(logger, opts.errorSample, opts.errorSampleFile)
+		opts.download.addOnComplete(sampler.hook)
+		defer func() {
+			if serr := sampler.finish(); serr != nil {
+				err = errors.Join(err, serr)
 			}
+		}()
+	}
 
-			file, err := os.Create(filePath)
-			if err != nil {
-				log.Printf("Failed to create file %s: %v", filePath, err)
-				return
+	if opts.checksumManifest != "" {
+		root := opts.localDir
+		if opts.decompress.outDir != "" {
+			root = opts.decompress.outDir
+		}
+		checksums, err := newChecksumWriter(opts.checksumManifest, root)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := checksums.close(); cerr != nil {
+				err = errors.Join(err, cerr)
 			}
-			defer file.Close()
+		}()
+		opts.decompress.checksums = checksums
+	}
 
-			_, err = downloader.Download(ctx, file, &s3.GetObjectInput{
-				Bucket: aws.String(bucket),
-				Key:    aws.String(key),
-			})
-			if err != nil {
-				log.Printf("Failed to download %s: %v", key, err)
-			} else {
-				log.Printf("Downloaded %s to %s", key, filePath)
+	// The tree shows what landed, even if the run failed part way.
+	if opts.printTree {
+		root := opts.localDir
+		if opts.decompress.outDir != "" {
+			root = opts.decompress.outDir
+		}
+		defer func() {
+			if terr := printLocalTree(os.Stdout, root, opts.printTreeDepth); terr != nil {
+				err = errors.Join(err, fmt.Errorf("print tree: %w", terr))
 			}
-		}(key)
+		}()
 	}
 
-	wg.Wait()
+	if len(opts.buckets) == 0 {
+		return runBucket(ctx, svc, opts)
+	}
+	var errs []error
+	for _, t := range opts.buckets {
+		bucketOpts := opts
+		bucketOpts.bucket = t.bucket
+		bucketOpts.localDir = filepath.Join(opts.localDir, t.bucket)
+		if opts.decompress.outDir != "" {
+			bucketOpts.decompress.outDir = filepath.Join(opts.decompress.outDir, t.bucket)
+		}
+		if t.prefix != "" {
+			bucketOpts.prefix = t.prefix
+			bucketOpts.prefixes = nil
+		}
+		bucketSvc := svc
+		if regions != nil {
+			bucketSvc = regions.client(t.bucket)
+			if region := regions.mappings()[t.bucket]; region != cfg.Region {
+				logger.Printf("s3://%s is in region %s", t.bucket, region)
+			}
+		}
+		logger.Printf("Processing s3://%s into %s", t.bucket, bucketOpts.localDir)
+		if err := runBucket(ctx, bucketSvc, bucketOpts); err != nil {
+			errs = append(errs, fmt.Errorf("s3://%s: %w", t.bucket, err))
+			if ctx.Err() != nil {
+				break
+			}
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func decompressGzipFiles(rootDir string) error {
-	return filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
+// runBucket performs the list, download and decompress pass for opts.bucket.
+func runBucket(ctx context.Context, svc *s3.Client, opts options) error {
+	logger := opts.logger
+
+	if opts.download.writesLocally() {
+		if err := os.MkdirAll(opts.localDir, os.ModePerm); err != nil {
+			return fmt.Errorf("create local directory: %w", err)
+		}
+	}
+	opts.decompress.srcDir = opts.localDir
+	opts.download.decompressed = opts.decompress
+
+	if opts.retryFrom != "" {
+		return retryFailures(ctx, svc, opts)
+	}
+
+	if opts.listVersions {
+		prefixes := opts.prefixes
+		if len(prefixes) == 0 {
+			prefixes = []string{opts.prefix}
+		}
+		var versions []objectVersion
+		for _, prefix := range prefixes {
+			logger.Printf("Listing object versions under s3://%s/%s", opts.bucket, prefix)
+			found, err := listVersions(ctx, svc, opts.bucket, prefix, opts.list.includeNonMatching)
+			if err != nil {
+				return err
+			}
+			versions = append(versions, found...)
+		}
+		return printVersions(os.Stdout, versions)
+	}
+
+	var state runState
+	if opts.sinceLastRun || opts.partitionDepth > 0 || opts.checkpointing() {
+		var err error
+		if state, err = loadState(opts.stateFile); err != nil {
+			return err
+		}
+	}
+	if opts.partitionDepth > 0 {
+		todo, done, err := newPartitions(ctx, svc, opts, state)
 		if err != nil {
 			return err
 		}
-
-		if info.IsDir() || !strings.HasSuffix(path, ".json.gz") {
+		if len(todo) == 0 {
 			return nil
 		}
+		opts.prefixes, opts.newPartitions = todo, done
+	}
+	if opts.sinceLastRun {
+		if !state.LastModified.IsZero() {
+			logger.Printf("Only collecting objects modified after %s", state.LastModified.Format(time.RFC3339))
+		}
+		opts.list.modifiedAfter = state.LastModified
+		opts.list.newest = &watermark{}
+	}
+
+	if opts.continueOnListError {
+		opts.list.skipped = &prefixList{}
+		defer func() {
+			if skipped := opts.list.skipped.list(); len(skipped) > 0 {
+				opts.summary.addSkippedPrefixes(opts.bucket, skipped)
+				logger.Printf("Incomplete listing: %d prefix(es) of s3://%s were skipped after errors: %s", len(skipped), opts.bucket, strings.Join(skipped, ", "))
+			}
+		}()
+	}
+
+	if opts.createEmptyDirs {
+		opts.list.dirMarkers = &prefixList{}
+	}
+
+	if opts.concurrentList {
+		return streamBucket(ctx, svc, opts, state)
+	}
+
+	var objects []types.Object
+	var err error
+	if opts.recoverDeleted {
+		prefixes := opts.prefixes
+		if len(prefixes) == 0 {
+			prefixes = []string{opts.prefix}
+		}
+		objects, opts.download.versions, err = recoverableObjects(ctx, logger, svc, opts.bucket, prefixes, opts.list.includeNonMatching)
+	} else if opts.inventory != "" {
+		prefixes := opts.prefixes
+		if len(prefixes) == 0 {
+			prefixes = []string{opts.prefix}
+		}
+		objects, err = inventoryObjects(ctx, logger, svc, opts.inventory, opts.bucket, prefixes, opts.list)
+	} else if opts.manifest != "" {
+		logger.Printf("Reading the objects to download from %s instead of listing", opts.manifest)
+		objects, err = readManifestObjects(opts.manifest)
+	} else {
+		objects, err = listBucket(ctx, svc, opts)
+	}
+	if err != nil {
+		return err
+	}
+	logger.Printf("Found %d matching files", len(objects))
+	if len(objects) == 0 && opts.manifest == "" {
+		if err := reportEmptyListing(ctx, svc, opts); err != nil {
+			return err
+		}
+	}
 
-		outputPath := strings.TrimSuffix(path, ".gz")
+	// Before anything else looks at the objects, so oversized ones are
+	// neither HEADed for their content type nor written to -manifest-only.
+	if opts.maxObjectSize > 0 {
+		var n int
+		objects, n = dropOversized(logger, objects, opts.maxObjectSize)
+		if n > 0 {
+			opts.summary.addTooLarge(n)
+			logger.Printf("Skipped %d files larger than -max-object-size %s, %d left", n, formatBytes(opts.maxObjectSize), len(objects))
+		}
+	}
 
-		gzFile, err := os.Open(path)
+	if opts.contentType != "" {
+		objects, err = filterByContentType(ctx, logger, svc, opts.bucket, objects, opts.contentType, opts.headWorkers)
 		if err != nil {
-			log.Printf("Failed to open %s: %v", path, err)
-			return nil
+			return fmt.Errorf("check content types: %w", err)
 		}
-		defer gzFile.Close()
+		logger.Printf("%d files have content type %s", len(objects), opts.contentType)
+	}
 
-		gzReader, err := gzip.NewReader(gzFile)
+	if tmpl := opts.download.template; tmpl != nil && tmpl.needsMetadata() {
+		if err := tmpl.loadMetadata(ctx, logger, svc, opts.bucket, objects, opts.headWorkers); err != nil {
+			return fmt.Errorf("read object metadata: %w", err)
+		}
+	}
+
+	if opts.sizesDepth > 0 {
+		printSizeTree(os.Stdout, objects, opts.sizesPrefix(), opts.sizesDepth)
+		return nil
+	}
+	if opts.listETags != "" {
+		return printETags(os.Stdout, objects, opts.listETags)
+	}
+
+	if opts.verifyOnly {
+		report, err := verifyLocal(logger, opts.localDir, objects, opts.download.template, opts.decompress.suffix, opts.verifyMD5)
 		if err != nil {
-			log.Printf("Failed to create gzip reader for %s: %v", path, err)
-			return nil
+			return fmt.Errorf("verify: %w", err)
+		}
+		logger.Printf("Verified %d files: %d matched, %d decompressed (not compared), %d missing, %d mismatched, %d extra",
+			len(objects), report.matched, len(report.unverified), len(report.missing), len(report.mismatched), len(report.extra))
+		if !report.ok() {
+			return errors.New("local files do not match S3")
+		}
+		return nil
+	}
+
+	if opts.deleteExtraneous {
+		// Everything under a skipped prefix would look extraneous.
+		if len(opts.list.skipped.list()) > 0 {
+			return errors.New("not deleting extraneous files: some prefixes could not be listed")
+		}
+		if err := deleteExtraneous(logger, opts.localDir, objects, opts.download.template, opts.decompress.suffix, opts.confirmDelete); err != nil {
+			return fmt.Errorf("delete extraneous files: %w", err)
 		}
-		defer gzReader.Close()
+	}
 
-		outFile, err := os.Create(outputPath)
+	if opts.resumeFrom != "" {
+		done, err := readManifest(opts.resumeFrom)
 		if err != nil {
-			log.Printf("Failed to create output file %s: %v", outputPath, err)
-			return nil
+			return err
 		}
-		defer outFile.Close()
+		before := len(objects)
+		objects = filterByManifest(objects, done)
+		logger.Printf("Skipping %d files already in %s, %d left to download", before-len(objects), opts.resumeFrom, len(objects))
+	}
 
-		_, err = io.Copy(outFile, gzReader)
+	if opts.manifestOnly != "" {
+		if err := writeListingManifest(opts.manifestOnly, objects); err != nil {
+			return err
+		}
+		logger.Printf("Wrote %d objects to %s; nothing was downloaded", len(objects), opts.manifestOnly)
+		return nil
+	}
+
+	var checkpoint *checkpointer
+	if opts.checkpointing() {
+		if done := state.completed(opts.bucket); len(done) > 0 {
+			before := len(objects)
+			objects = filterByManifest(objects, done)
+			logger.Printf("Skipping %d files completed before the last checkpoint in %s, %d left to download", before-len(objects), opts.stateFile, len(objects))
+		}
+		checkpoint = startCheckpointer(logger, opts.stateFile, opts.bucket, state, objects, opts.checkpointInterval, opts.checkpointFiles)
+		opts.download.addOnComplete(checkpoint.hook)
+	}
+
+	keys := objectKeys(objects)
+	if tmpl := opts.download.template; tmpl != nil && tmpl.strip != "" {
+		if n := tmpl.unstripped(keys); n > 0 {
+			logger.Printf("Warning: %d of %d keys don't start with -strip-prefix %q and keep their full path", n, len(keys), tmpl.strip)
+		}
+	}
+	if opts.preserveMtime {
+		opts.download.modTimes = make(map[string]time.Time, len(objects))
+		for _, obj := range objects {
+			opts.download.modTimes[aws.ToString(obj.Key)] = aws.ToTime(obj.LastModified)
+		}
+	}
+	opts.summary.addObjects(opts.bucket, objects)
+	opts.download.addOnComplete(opts.summary.hook(opts.bucket))
+	var progress *progressStream
+	if opts.progressOut != nil {
+		progress = startProgressStream(opts.progressOut, opts.bucket, objects, opts.progressInterval)
+		opts.download.addOnComplete(progress.hook)
+	}
+	if opts.download.writesLocally() {
+		if err := createMarkedDirs(logger, opts.localDir, opts.list.dirMarkers.list()); err != nil {
+			return err
+		}
+		if opts.download.onExisting == onExistingError {
+			if existing := existingTargets(opts.localDir, keys, opts.download); len(existing) > 0 {
+				return fmt.Errorf("%d local file(s) already exist (first: %s); refusing to overwrite with -on-existing=error", len(existing), existing[0])
+			}
+		}
+		if err := checkInodes(logger, opts.localDir, keys, opts.download.template, opts.minFreeInodes); err != nil {
+			return err
+		}
+	}
+
+	var merge *mergeWriter
+	if opts.mergeOut != "" {
+		merge, err = newMergeWriter(opts.mergeOut, keys, opts.orderedMerge, opts.gzipLevel, opts.normalizeNewlines)
 		if err != nil {
-			log.Printf("Failed to decompress %s to %s: %v", path, outputPath, err)
-			return nil
+			return err
 		}
+		opts.download.addOnComplete(merge.add)
+	}
 
-		log.Printf("Decompressed %s to %s", path, outputPath)
+	var manifest *manifestWriter
+	if opts.writeManifest != "" {
+		manifest, err = newManifestWriter(opts.writeManifest, objects)
+		if err != nil {
+			return err
+		}
+		if opts.manifestChecksums {
+			manifest.includeChecksums(logger)
+		}
+		opts.download.addOnComplete(manifest.add)
+	}
 
-		if err := os.Remove(path); err != nil {
-			log.Printf("Warning: Failed to remove original file %s: %v", path, err)
+	var failures *manifestWriter
+	if opts.failuresOut != "" {
+		failures, err = newFailuresWriter(opts.failuresOut, objects)
+		if err != nil {
+			return err
 		}
+		opts.download.addOnComplete(failures.add)
+	}
+
+	var pool *decompressPool
+	if opts.pipelineWorkers > 0 && opts.download.writesLocally() {
+		pool = startDecompressPool(logger, opts.pipelineWorkers, opts.decompress)
+		defer pool.stop()
+		opts.download.addOnComplete(pool.submit)
+	}
+
+	var deleter *objectDeleter
+	if opts.deleteAfter {
+		deleter = newObjectDeleter(ctx, logger, svc, opts.bucket)
+		opts.download.addOnComplete(deleter.hook)
+	}
+
+	if opts.warmConnections > 0 && len(keys) > 0 {
+		warmConnections(ctx, logger, svc, opts.bucket, opts.warmConnections, opts.list.verbose)
+	}
 
+	// Download failures don't stop the run: whatever did arrive is still
+	// decompressed, and the failures are reported once that is done.
+	downloadErr := downloadFiles(ctx, logger, svc, opts.bucket, opts.localDir, keys, opts.download)
+	if checkpoint != nil {
+		if err := checkpoint.close(); err != nil {
+			downloadErr = errors.Join(downloadErr, fmt.Errorf("save checkpoint: %w", err))
+		}
+	}
+	if progress != nil {
+		if err := progress.stop(); err != nil {
+			logger.Printf("Warning: failed to write progress events: %v", err)
+		}
+	}
+	if ctx.Err() != nil {
+		return errors.New("interrupted, skipping decompression")
+	}
+	if downloadErr != nil {
+		downloadErr = fmt.Errorf("some downloads failed: %w", downloadErr)
+	}
+	if manifest != nil {
+		if err := manifest.close(); err != nil {
+			downloadErr = errors.Join(downloadErr, err)
+		}
+	}
+	if failures != nil {
+		if err := failures.close(); err != nil {
+			downloadErr = errors.Join(downloadErr, err)
+		} else if downloadErr != nil {
+			logger.Printf("Recorded failed downloads in %s; rerun with -retry %s", opts.failuresOut, opts.failuresOut)
+		}
+	}
+	if merge != nil {
+		if err := merge.close(); err != nil {
+			downloadErr = errors.Join(downloadErr, err)
+		} else {
+			logger.Printf("Wrote merged output to %s", opts.mergeOut)
+		}
+	}
+	return finishBucket(opts, state, pool, deleter, downloadErr)
+}
+
+// finishBucket ends runBucket and streamBucket once their downloads are
+// done: it waits for the deletions of -delete-after, decompresses what
+// arrived, and records the run for -since-last-run if nothing failed.
+// downloadErr holds every failure so far.
+func finishBucket(opts options, state runState, pool *decompressPool, deleter *objectDeleter, downloadErr error) error {
+	logger := opts.logger
+	if deleter != nil {
+		if err := deleter.finish(opts.summary); err != nil {
+			downloadErr = errors.Join(downloadErr, fmt.Errorf("some deletions failed: %w", err))
+		}
+	}
+
+	if opts.download.failFast && downloadErr != nil {
+		return downloadErr
+	}
+	if opts.download.rangeBytes > 0 && opts.download.writesLocally() {
+		logger.Printf("Skipping decompression: -range-bytes only fetched the start of each object")
+		return downloadErr
+	}
+	if pool != nil {
+		if err := pool.wait(); err != nil {
+			return errors.Join(downloadErr, fmt.Errorf("decompress files: %w", err))
+		}
+	} else if opts.download.writesLocally() {
+		logger.Printf("Decompressing %s files...", matchSuffix)
+		if err := decompressGzipFiles(logger, opts.localDir, opts.decompress); err != nil {
+			return errors.Join(downloadErr, fmt.Errorf("decompress files: %w", err))
+		}
+	}
+	if downloadErr != nil {
+		return downloadErr
+	}
+	return recordState(opts, state)
+}
+
+// reportEmptyListing warns, or with opts.strict fails, when a listing found
+// nothing to download, saying why as explainEmptyListing found out.
+func reportEmptyListing(ctx context.Context, svc *s3.Client, opts options) error {
+	prefixes := opts.prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{opts.prefix}
+	}
+	why, err := explainEmptyListing(ctx, svc, opts.bucket, prefixes)
+	if err != nil {
+		opts.logger.Printf("Warning: %v", err)
+	} else if opts.strict {
+		return fmt.Errorf("nothing to download: %s", why)
+	} else {
+		opts.logger.Printf("Warning: nothing to download: %s", why)
+	}
+	return nil
+}
+
+// recordState saves the newest LastModified collected as the
+// -since-last-run watermark, and the partitions -only-new-partitions
+// downloaded as seen. Only call it once everything up to them is safely on
+// disk; otherwise the failed objects would be skipped by the next run. A
+// -checkpoint-interval checkpoint is cleared, the run being complete.
+func recordState(opts options, state runState) error {
+	if !opts.sinceLastRun && len(opts.newPartitions) == 0 && !opts.checkpointing() {
 		return nil
-	})
+	}
+	if len(opts.list.skipped.list()) > 0 {
+		opts.logger.Printf("Not recording run state: objects under the skipped prefixes would never be collected")
+		return nil
+	}
+	newest := opts.list.newest.get()
+	moved := opts.sinceLastRun && newest.After(state.LastModified)
+	if !moved && len(opts.newPartitions) == 0 && !opts.checkpointing() {
+		return nil
+	}
+	if moved {
+		state.LastModified = newest
+	}
+	state.Checkpoint = nil
+	state.Partitions = append(state.Partitions, opts.newPartitions...)
+	if err := saveState(opts.stateFile, state); err != nil {
+		return err
+	}
+	if moved {
+		opts.logger.Printf("Recorded watermark %s in %s", newest.Format(time.RFC3339), opts.stateFile)
+	}
+	if len(opts.newPartitions) > 0 {
+		opts.logger.Printf("Recorded %d partition(s) as seen in %s", len(opts.newPartitions), opts.stateFile)
+	}
+	return nil
+}
+
+// listBucket collects the objects to work on in opts.bucket, from the
+// -list-cache when it holds a usable listing, and otherwise by listing.
+func listBucket(ctx context.Context, svc *s3.Client, opts options) ([]types.Object, error) {
+	logger := opts.logger
+
+	source := listingSource(opts)
+	if opts.listCache != "" && !opts.refreshCache {
+		objects, ok, why, err := loadListCache(opts.listCache, source, opts.listCacheTTL)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			logger.Printf("Using the cached listing in %s", opts.listCache)
+			if opts.list.newest != nil {
+				for _, obj := range objects {
+					opts.list.newest.observe(aws.ToTime(obj.LastModified))
+				}
+			}
+			return objects, nil
+		}
+		if why != "" {
+			logger.Printf("Not using the cached listing in %s: %s", opts.listCache, why)
+		}
+	}
+
+	listCtx := ctx
+	if opts.maxListingTime > 0 {
+		var cancel context.CancelFunc
+		listCtx, cancel = context.WithTimeout(ctx, opts.maxListingTime)
+		defer cancel()
+	}
+
+	var objects []types.Object
+	var err error
+	if opts.list.continuationToken != "" || opts.list.maxFiles > 0 {
+		var next string
+		objects, next, err = collectPage(listCtx, logger, svc, opts.bucket, opts.prefix, opts.list)
+		if err == nil {
+			if next != "" {
+				logger.Printf("Stopped listing after %d files; continue with -continuation-token %s", len(objects), next)
+			}
+			opts.summary.setContinuationToken(next)
+		}
+	} else if len(opts.prefixes) > 0 {
+		logger.Printf("Listing %d prefixes", len(opts.prefixes))
+		objects, err = collectPrefixes(listCtx, logger, svc, opts.bucket, opts.prefixes, opts.list, opts.listWorkers)
+	} else {
+		err = collectRecursive(listCtx, logger, svc, opts.bucket, opts.prefix, opts.list, &objects)
+	}
+	if ctx.Err() == nil && errors.Is(listCtx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("listing s3://%s took longer than -max-listing-time %s; try a narrower prefix", opts.bucket, opts.maxListingTime)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// A listing with skipped prefixes is incomplete, so it must not be
+	// reused.
+	if opts.listCache != "" && len(opts.list.skipped.list()) == 0 {
+		if err := saveListCache(opts.listCache, source, objects); err != nil {
+			return nil, err
+		}
+		logger.Printf("Saved the listing to %s", opts.listCache)
+	}
+	return objects, nil
 }
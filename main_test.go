@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseOptionsRejectsInvalidFlags(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-page-size", "0"}, "-page-size"},
+		{[]string{"-on-existing", "keep"}, "-on-existing"},
+		{[]string{"-ordered-merge"}, "-ordered-merge requires -merge-out"},
+		{[]string{"-endpoint", "localhost:9000"}, "-endpoint"},
+		{[]string{"-signing-region", "eu-west-1"}, "-signing-region requires -endpoint"},
+	}
+	for _, tt := range tests {
+		_, err := parseOptions(append(tt.args, "-log-file", filepath.Join(t.TempDir(), "log")))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseOptions(%q) = %v, want an error about %s", tt.args, err, tt.want)
+		}
+	}
+	var usage usageError
+	if _, err := parseOptions([]string{"-no-such-flag"}); !errors.As(err, &usage) {
+		t.Errorf("unknown flag: got %v, want a usage error", err)
+	}
+}
+
+// fakeS3 serves ListObjectsV2 for every object in objects, under any
+// prefix, and GetObject for each of them, gzip-compressed unless listed in
+// missing, which answer 403.
+func fakeS3(t *testing.T, objects map[string]string, missing map[string]bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+		switch {
+		case r.URL.Query().Get("list-type") == "2":
+			var b strings.Builder
+			b.WriteString(`<?xml version="1.0" encoding="UTF-8"?><ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>bucket</Name><IsTruncated>false</IsTruncated>`)
+			for key, content := range objects {
+				if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+					fmt.Fprintf(&b, `<Contents><Key>%s</Key><Size>%d</Size><ETag>"e"</ETag></Contents>`, key, len(content))
+				}
+			}
+			b.WriteString(`</ListBucketResult>`)
+			w.Header().Set("Content-Type", "application/xml")
+			w.Write([]byte(b.String()))
+		case missing[key]:
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`))
+		case objects[key] != "":
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			gz.Write([]byte(objects[key]))
+			gz.Close()
+			w.Header().Set("Content-Length", fmt.Sprint(buf.Len()))
+			w.Header().Set("ETag", `"e"`)
+			w.Write(buf.Bytes())
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code></Error>`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRunAgainstFakeS3(t *testing.T) {
+	objects := map[string]string{
+		"data/a.json.gz":     "{\"a\":1}\n",
+		"data/sub/b.json.gz": "{\"b\":2}\n",
+	}
+	tests := []struct {
+		name    string
+		missing map[string]bool
+		wantErr string
+	}{
+		{name: "ok"},
+		{name: "download fails", missing: map[string]bool{"data/sub/b.json.gz": true}, wantErr: "data/sub/b.json.gz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := fakeS3(t, objects, tt.missing)
+			dir := t.TempDir()
+			opts, err := parseOptions([]string{
+				"-bucket", "bucket", "-prefix", "data/", "-out", dir,
+				"-endpoint", srv.URL, "-region", "us-east-1",
+				"-access-key", "AKID", "-secret-key", "SECRET",
+				"-log-file", filepath.Join(t.TempDir(), "log"),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range opts.closers {
+				t.Cleanup(func() { c.Close() })
+			}
+			err = run(context.Background(), opts)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("run = %v, want an error about %s", err, tt.wantErr)
+			}
+
+			for key, content := range objects {
+				out := filepath.Join(dir, strings.TrimSuffix(key, ".gz"))
+				data, err := os.ReadFile(out)
+				if tt.missing[key] {
+					if err == nil {
+						t.Errorf("%s written for a failed download", out)
+					}
+					continue
+				}
+				if string(data) != content {
+					t.Errorf("%s = %q (%v), want %q", out, data, err, content)
+				}
+			}
+		})
+	}
+}
+
+func TestRunToMemoryWritesNothingLocally(t *testing.T) {
+	objects := map[string]string{
+		"data/a.json.gz":     "{\"a\":1}\n",
+		"data/sub/b.json.gz": "{\"b\":2}\n",
+	}
+	srv := fakeS3(t, objects, nil)
+	dir := filepath.Join(t.TempDir(), "out")
+	opts, err := parseOptions([]string{
+		"-bucket", "bucket", "-prefix", "data/", "-out", dir,
+		"-endpoint", srv.URL, "-region", "us-east-1",
+		"-access-key", "AKID", "-secret-key", "SECRET",
+		"-log-file", filepath.Join(t.TempDir(), "log"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range opts.closers {
+		t.Cleanup(func() { c.Close() })
+	}
+	var mu sync.Mutex
+	got := map[string]string{}
+	opts.download.toMemory = func(key string, data []byte) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: %v", key, err)
+			return
+		}
+		content, err := io.ReadAll(zr)
+		if err != nil {
+			t.Errorf("%s: %v", key, err)
+		}
+		mu.Lock()
+		got[key] = string(content)
+		mu.Unlock()
+	}
+	if err := run(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, content := range objects {
+		if got[key] != content {
+			t.Errorf("%s = %q, want %q", key, got[key], content)
+		}
+	}
+	if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%s exists after an in-memory run (%v)", dir, err)
+	}
+}
+
+func TestConcurrentListFailFastStopsListing(t *testing.T) {
+	const pages = 100
+	var listed atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("list-type") != "2" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`))
+			return
+		}
+		listed.Add(1)
+		page := 0
+		fmt.Sscan(r.URL.Query().Get("continuation-token"), &page)
+		time.Sleep(10 * time.Millisecond)
+		next := ""
+		if page+1 < pages {
+			next = fmt.Sprintf(`<NextContinuationToken>%d</NextContinuationToken>`, page+1)
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>bucket</Name><IsTruncated>%t</IsTruncated>%s<Contents><Key>data/%03d.json.gz</Key><Size>10</Size><ETag>"e"</ETag></Contents></ListBucketResult>`, next != "", next, page)
+	}))
+	t.Cleanup(srv.Close)
+
+	opts, err := parseOptions([]string{
+		"-bucket", "bucket", "-prefix", "data/", "-out", t.TempDir(),
+		"-endpoint", srv.URL, "-region", "us-east-1",
+		"-access-key", "AKID", "-secret-key", "SECRET",
+		"-concurrent-list-and-download", "-fail-fast",
+		"-log-file", filepath.Join(t.TempDir(), "log"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range opts.closers {
+		t.Cleanup(func() { c.Close() })
+	}
+	err = run(context.Background(), opts)
+	if !errors.Is(err, errFailFast) {
+		t.Fatalf("run = %v, want a -fail-fast error", err)
+	}
+	if n := listed.Load(); n >= pages {
+		t.Errorf("listed all %d pages after the first download failed", n)
+	}
+}
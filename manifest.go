@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// A manifest is a tab-separated text file with one object per line:
+//
+//	key<TAB>etag
+//
+// With checksums, a manifest writer adds the object's size and the
+// SHA-256 of the local file:
+//
+//	key<TAB>etag<TAB>size<TAB>sha256
+//
+// Blank lines and lines starting with '#' are ignored, as are any columns
+// after the ones listed, so the format can grow without breaking readers.
+
+// manifestWriter appends a line for every object that is in place locally as
+// its download completes, so the manifest is usable even if the run dies.
+// It is fed from downloadOptions.onComplete.
+type manifestWriter struct {
+	mu    sync.Mutex
+	file  *os.File
+	w     *bufio.Writer
+	etags map[string]string
+	sizes map[string]int64
+	// checksums adds the size and the SHA-256 of the local file to each
+	// line, after checking the file's MD5 against a plain-MD5 ETag; a file
+	// that fails that check is left out and logged to logger.
+	checksums bool
+	logger    *log.Logger
+	// failures inverts the writer to record the objects that did not make
+	// it, with the error as a third column.
+	failures bool
+	err      error
+}
+
+func newManifestWriter(path string, objects []types.Object) (*manifestWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create manifest: %w", err)
+	}
+	etags := make(map[string]string, len(objects))
+	sizes := make(map[string]int64, len(objects))
+	for _, obj := range objects {
+		etags[aws.ToString(obj.Key)] = aws.ToString(obj.ETag)
+		sizes[aws.ToString(obj.Key)] = aws.ToInt64(obj.Size)
+	}
+	return &manifestWriter{file: file, w: bufio.NewWriter(file), etags: etags, sizes: sizes}, nil
+}
+
+// includeChecksums turns on the size and checksum columns.
+func (m *manifestWriter) includeChecksums(logger *log.Logger) {
+	m.checksums = true
+	m.logger = logger
+}
+
+// newFailuresWriter is like newManifestWriter but records every object whose
+// download failed, for -retry to pick up later.
+func newFailuresWriter(path string, objects []types.Object) (*manifestWriter, error) {
+	m, err := newManifestWriter(path, objects)
+	if err != nil {
+		return nil, err
+	}
+	m.failures = true
+	return m, nil
+}
+
+// add records key if it is available locally, or for a failures writer if
+// it is not. Duplicates dropped by -dedupe count as done: their content is
+// already present under another key.
+func (m *manifestWriter) add(key, path string, err error) {
+	failed := err != nil && !errors.Is(err, errDuplicate)
+	if failed != m.failures {
+		return
+	}
+	line := key + "\t" + m.etags[key]
+	if failed {
+		// Keep the error on one line so the file stays one object per line.
+		line += "\t" + strings.Join(strings.Fields(err.Error()), " ")
+	} else if m.checksums {
+		sum, ok := m.checksum(key, path, err)
+		if !ok {
+			return
+		}
+		line += fmt.Sprintf("\t%d\t%s", m.sizes[key], sum)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return
+	}
+	if _, m.err = fmt.Fprintln(m.w, line); m.err == nil {
+		m.err = m.w.Flush()
+	}
+}
+
+// checksum returns the SHA-256 of the local copy of key at path. When the
+// copy has the listed size and the ETag is a plain MD5, the MD5 must match
+// too, or ok is false. The checksum is empty when there is no local file to
+// hash: a duplicate dropped by -dedupe, or a copy sent on by -upload-to.
+func (m *manifestWriter) checksum(key, path string, err error) (sum string, ok bool) {
+	if path == "" || err != nil {
+		return "", true
+	}
+	info, statErr := os.Stat(path)
+	if statErr != nil {
+		m.logger.Printf("Leaving %s out of the manifest: %v", key, statErr)
+		return "", false
+	}
+	md5sum, sum, hashErr := fileDigests(path)
+	if hashErr != nil {
+		m.logger.Printf("Leaving %s out of the manifest: %v", key, hashErr)
+		return "", false
+	}
+	// A decompressed copy or a -range-bytes prefix has nothing to compare.
+	if want, ok := etagMD5(m.etags[key]); ok && info.Size() == m.sizes[key] && md5sum != want {
+		m.logger.Printf("Leaving %s out of the manifest: local MD5 %s does not match ETag %s", key, md5sum, want)
+		return "", false
+	}
+	return sum, true
+}
+
+// fileDigests hashes the file at path with MD5 and SHA-256 in one pass.
+func fileDigests(path string) (md5sum, sha256sum string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	m, s := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(m, s), f); err != nil {
+		return "", "", fmt.Errorf("hash %s: %w", path, err)
+	}
+	return hex.EncodeToString(m.Sum(nil)), hex.EncodeToString(s.Sum(nil)), nil
+}
+
+func (m *manifestWriter) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.file.Close(); m.err == nil {
+		m.err = err
+	}
+	if m.err != nil {
+		return fmt.Errorf("write manifest: %w", m.err)
+	}
+	return nil
+}
+
+// readManifest loads a manifest as a key -> ETag map.
+func readManifest(path string) (map[string]string, error) {
+	entries := make(map[string]string)
+	err := scanManifest(path, func(fields []string) {
+		etag := ""
+		if len(fields) > 1 {
+			etag = fields[1]
+		}
+		entries[fields[0]] = etag
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// scanManifest calls fn with the columns of every object line in the
+// manifest at path.
+func scanManifest(path string, fn func(fields []string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("read manifest: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fn(strings.Split(line, "\t"))
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("read manifest %s: %w", path, err)
+	}
+	return nil
+}
+
+// readManifestObjects loads a manifest as the objects to download, for
+// -manifest, in key order. A later line for the same key replaces an
+// earlier one. Sizes come from the size column of manifests that have one;
+// the third column of a failures file is an error, not a size, and is
+// ignored.
+func readManifestObjects(path string) ([]types.Object, error) {
+	byKey := make(map[string]types.Object)
+	err := scanManifest(path, func(fields []string) {
+		obj := types.Object{Key: aws.String(fields[0])}
+		if len(fields) > 1 && fields[1] != "" {
+			obj.ETag = aws.String(fields[1])
+		}
+		if len(fields) > 3 {
+			if size, err := strconv.ParseInt(fields[2], 10, 64); err == nil {
+				obj.Size = aws.Int64(size)
+			}
+		}
+		byKey[fields[0]] = obj
+	})
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]types.Object, 0, len(byKey))
+	for _, key := range slices.Sorted(maps.Keys(byKey)) {
+		objects = append(objects, byKey[key])
+	}
+	return objects, nil
+}
+
+// writeListingManifest writes objects to path as a manifest with checksums
+// whose checksum column is empty, since nothing has been downloaded yet, for
+// -manifest-only. -manifest and -resume-from read it like any other.
+func writeListingManifest(path string, objects []types.Object) error {
+	var buf bytes.Buffer
+	for _, obj := range objects {
+		fmt.Fprintf(&buf, "%s\t%s\t%d\t\n", aws.ToString(obj.Key), aws.ToString(obj.ETag), aws.ToInt64(obj.Size))
+	}
+	if err := writeFileAtomic(path, buf.Bytes()); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	return nil
+}
+
+// filterByManifest drops objects that the manifest already has with the
+// same ETag. Objects whose ETag changed since are kept so they're fetched
+// again.
+func filterByManifest(objects []types.Object, done map[string]string) []types.Object {
+	kept := objects[:0:0]
+	for _, obj := range objects {
+		if etag, ok := done[aws.ToString(obj.Key)]; ok && etag == aws.ToString(obj.ETag) {
+			continue
+		}
+		kept = append(kept, obj)
+	}
+	return kept
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// mergeWriter concatenates the content of every downloaded file into a single
+// output, decompressing .gz files on the way. It is fed from
+// downloadOptions.onComplete.
+//
+// Unordered, files are appended as their downloads finish. Ordered, the
+// downloaded files themselves act as the staging area: a finished file is
+// only remembered by path until every key sorting before it has been
+// reported, then the contiguous run is flushed in key order. Memory use is
+// therefore independent of file size, at the cost of keeping files on disk
+// until their turn comes.
+//
+// An output path ending in .gz is recompressed at the configured level.
+type mergeWriter struct {
+	mu   sync.Mutex
+	path string
+	out  *os.File
+	gz   *gzip.Writer
+	w    io.Writer
+
+	ordered bool
+	index   map[string]int // key -> position in sorted order
+	ready   map[int]string // finished position -> local path, "" if failed
+	next    int
+
+	// normalize ends every file's content with exactly one newline, so
+	// NDJSON records from adjacent files never share a line.
+	normalize bool
+
+	errs []error
+}
+
+func newMergeWriter(path string, keys []string, ordered bool, gzipLevel int, normalize bool) (*mergeWriter, error) {
+	out, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create merge output: %w", err)
+	}
+	m := &mergeWriter{path: path, out: out, w: out, ordered: ordered, normalize: normalize}
+	if strings.HasSuffix(path, ".gz") {
+		m.gz, err = gzip.NewWriterLevel(out, gzipLevel)
+		if err != nil {
+			out.Close()
+			return nil, fmt.Errorf("create merge output: %w", err)
+		}
+		m.w = m.gz
+	}
+	if ordered {
+		sorted := append([]string(nil), keys...)
+		sort.Strings(sorted)
+		m.index = make(map[string]int, len(sorted))
+		for i, key := range sorted {
+			m.index[key] = i
+		}
+		m.ready = make(map[int]string)
+	}
+	return m, nil
+}
+
+// add records the outcome for key. Failed keys are left out of the output
+// but still advance the ordered cursor so later files aren't held back.
+func (m *mergeWriter) add(key, path string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		path = ""
+	}
+	if !m.ordered {
+		if path != "" {
+			m.appendFile(path)
+		}
+		return
+	}
+
+	m.ready[m.index[key]] = path
+	for {
+		path, ok := m.ready[m.next]
+		if !ok {
+			return
+		}
+		delete(m.ready, m.next)
+		m.next++
+		if path != "" {
+			m.appendFile(path)
+		}
+	}
+}
+
+func (m *mergeWriter) appendFile(path string) {
+	in, err := os.Open(path)
+	if err != nil {
+		m.errs = append(m.errs, fmt.Errorf("merge %s: %w", path, err))
+		return
+	}
+	defer in.Close()
+
+	var src io.Reader = in
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			m.errs = append(m.errs, fmt.Errorf("merge %s: %w", path, err))
+			return
+		}
+		defer gz.Close()
+		src = gz
+	}
+
+	if !m.normalize {
+		if _, err := io.Copy(m.w, src); err != nil {
+			m.errs = append(m.errs, fmt.Errorf("merge %s: %w", path, err))
+		}
+		return
+	}
+
+	le := &lineEnder{w: m.w}
+	_, err = io.Copy(le, src)
+	if err == nil {
+		err = le.finish()
+	}
+	if err != nil {
+		m.errs = append(m.errs, fmt.Errorf("merge %s: %w", path, err))
+	}
+}
+
+// lineEnder passes writes through but holds back trailing newlines, so that
+// finish can end non-empty content with exactly one. Newlines followed by
+// more content are written unchanged.
+type lineEnder struct {
+	w       io.Writer
+	pending int
+	wrote   bool
+}
+
+func (l *lineEnder) Write(p []byte) (int, error) {
+	body := bytes.TrimRight(p, "\n")
+	if len(body) == 0 {
+		l.pending += len(p)
+		return len(p), nil
+	}
+	if l.pending > 0 {
+		if _, err := l.w.Write(bytes.Repeat([]byte{'\n'}, l.pending)); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := l.w.Write(body); err != nil {
+		return 0, err
+	}
+	l.wrote = true
+	l.pending = len(p) - len(body)
+	return len(p), nil
+}
+
+func (l *lineEnder) finish() error {
+	if !l.wrote {
+		return nil
+	}
+	_, err := l.w.Write([]byte{'\n'})
+	return err
+}
+
+// close finishes the output and returns every error hit while merging.
+func (m *mergeWriter) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ordered && len(m.ready) > 0 {
+		m.errs = append(m.errs, fmt.Errorf("merge: %d file(s) never flushed because an earlier key was not reported", len(m.ready)))
+	}
+	if m.gz != nil {
+		if err := m.gz.Close(); err != nil {
+			m.errs = append(m.errs, fmt.Errorf("close merge output: %w", err))
+		}
+	}
+	if err := m.out.Close(); err != nil {
+		m.errs = append(m.errs, fmt.Errorf("close merge output: %w", err))
+	}
+	return errors.Join(m.errs...)
+}
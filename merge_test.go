@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMergeEndsEveryFileWithOneNewline(t *testing.T) {
+	dir := t.TempDir()
+	files := []struct {
+		key, content string
+		records      int
+	}{
+		{"a.json", `{"r":1}`, 1},
+		{"b.json", "{\"r\":2}\n", 1},
+		{"c.json", "{\"r\":3}\n{\"r\":4}\n\n\n", 2},
+		{"d.json", "", 0},
+		{"e.json", "\n\n", 0},
+		{"f.json.gz", "{\"r\":5}\n{\"r\":6}", 2},
+	}
+	var keys []string
+	records := 0
+	for _, f := range files {
+		path := filepath.Join(dir, f.key)
+		if strings.HasSuffix(f.key, ".gz") {
+			writeGzip(t, path, f.content)
+		} else {
+			os.WriteFile(path, []byte(f.content), 0o644)
+		}
+		keys = append(keys, f.key)
+		records += f.records
+	}
+
+	out := filepath.Join(t.TempDir(), "merged.json")
+	m, err := newMergeWriter(out, keys, true, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reported out of order; the ordered merge puts them back.
+	for i := len(files) - 1; i >= 0; i-- {
+		m.add(files[i].key, filepath.Join(dir, files[i].key), nil)
+	}
+	if err := m.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "{\"r\":1}\n{\"r\":2}\n{\"r\":3}\n{\"r\":4}\n{\"r\":5}\n{\"r\":6}\n"
+	if string(data) != want {
+		t.Errorf("merged output = %q, want %q", data, want)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != records {
+		t.Errorf("merged output has %d lines, want one per record, %d", lines, records)
+	}
+}
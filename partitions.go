@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// listPartitions returns the prefixes depth "/"-delimited levels below
+// prefix, such as miner_data/2025/10/20/13/ at depth 4 below miner_data/,
+// in sorted order. Only CommonPrefixes are listed, so it costs about one
+// request per prefix above the partition level, however many objects the
+// partitions hold. Objects above that level are not part of any partition.
+func listPartitions(ctx context.Context, svc *s3.Client, bucket, prefix string, depth int) ([]string, error) {
+	level := []string{prefix}
+	for range depth {
+		var next []string
+		for _, p := range level {
+			paginator := s3.NewListObjectsV2Paginator(svc, &s3.ListObjectsV2Input{
+				Bucket:    aws.String(bucket),
+				Prefix:    aws.String(p),
+				Delimiter: aws.String("/"),
+			})
+			for paginator.HasMorePages() {
+				page, err := paginator.NextPage(ctx)
+				if err != nil {
+					return nil, fmt.Errorf("list partitions under s3://%s/%s: %w", bucket, p, err)
+				}
+				for _, cp := range page.CommonPrefixes {
+					next = append(next, aws.ToString(cp.Prefix))
+				}
+			}
+		}
+		level = next
+	}
+	slices.Sort(level)
+	return level, nil
+}
+
+// partitionID is how a partition is recorded in the state file, so one
+// file can serve several buckets.
+func partitionID(bucket, partition string) string {
+	return "s3://" + bucket + "/" + partition
+}
+
+// newPartitions returns the partitions of opts.bucket under opts.prefix
+// that state doesn't record as seen, and those of them to record once the
+// run succeeds. The last partition in sort order is always returned and
+// never recorded: on an append-only layout it is the one still being
+// written to, so it is listed again until a newer one appears.
+func newPartitions(ctx context.Context, svc *s3.Client, opts options, state runState) (todo, done []string, err error) {
+	partitions, err := listPartitions(ctx, svc, opts.bucket, opts.prefix, opts.partitionDepth)
+	if err != nil {
+		return nil, nil, err
+	}
+	seen := make(map[string]bool, len(state.Partitions))
+	for _, id := range state.Partitions {
+		seen[id] = true
+	}
+	for i, p := range partitions {
+		last := i == len(partitions)-1
+		if seen[partitionID(opts.bucket, p)] && !last {
+			continue
+		}
+		todo = append(todo, p)
+		if !last {
+			done = append(done, partitionID(opts.bucket, p))
+		}
+	}
+	opts.logger.Printf("Found %d partition(s) under s3://%s/%s, %d to download", len(partitions), opts.bucket, opts.prefix, len(todo))
+	return todo, done, nil
+}
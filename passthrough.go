@@ -0,0 +1,115 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// passthrough sends objects on to another bucket as they are read, instead
+// of writing them locally, optionally decompressing them on the way.
+type passthrough struct {
+	uploader *manager.Uploader
+	bucket   string
+	prefix   string
+	// decompress gunzips matching objects and drops their .gz suffix.
+	decompress bool
+}
+
+func newPassthrough(dst *s3.Client, target string, decompress bool) (*passthrough, error) {
+	bucket, prefix, err := parseS3URL(target)
+	if err != nil {
+		return nil, err
+	}
+	uploader := manager.NewUploader(dst, func(u *manager.Uploader) {
+		// Bodies are streams, so every concurrent part is a buffered
+		// PartSize chunk; keep that per-object memory small since many
+		// objects are in flight at once.
+		u.Concurrency = 2
+	})
+	return &passthrough{uploader: uploader, bucket: bucket, prefix: prefix, decompress: decompress}, nil
+}
+
+// parseS3URL splits an s3://bucket/prefix URL.
+func parseS3URL(s string) (bucket, prefix string, err error) {
+	rest, ok := strings.CutPrefix(s, "s3://")
+	if !ok {
+		return "", "", fmt.Errorf("invalid S3 URL %q: must start with s3://", s)
+	}
+	bucket, prefix, _ = strings.Cut(rest, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("invalid S3 URL %q: missing bucket", s)
+	}
+	return bucket, prefix, nil
+}
+
+// url returns the destination of key, as an s3:// URL for logging.
+func (p *passthrough) url(key string) string {
+	return "s3://" + p.bucket + "/" + p.destKey(key)
+}
+
+func (p *passthrough) destKey(key string) string {
+	if p.decompress && strings.HasSuffix(key, matchSuffix) {
+		key = strings.TrimSuffix(key, ".gz")
+	}
+	return p.prefix + key
+}
+
+// copy streams key from bucket on svc to its destination and returns the
+// number of bytes uploaded. With rangeBytes only the start of the object is
+// sent.
+func (p *passthrough) copy(ctx context.Context, svc *s3.Client, bucket, key string, rangeBytes int64) (int64, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if rangeBytes > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=0-%d", rangeBytes-1))
+	}
+	out, err := svc.GetObject(ctx, input)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Body.Close()
+
+	var body io.Reader = out.Body
+	if p.decompress && strings.HasSuffix(key, matchSuffix) {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return 0, fmt.Errorf("create gzip reader: %w", err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	// A read error, including a bad gzip checksum at the end of the stream,
+	// aborts the upload, so nothing incomplete is left at the destination.
+	counted := &countingReader{r: body}
+	_, err = p.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(p.bucket),
+		Key:    aws.String(p.destKey(key)),
+		Body:   counted,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("upload to %s: %w", p.url(key), err)
+	}
+	return counted.n, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
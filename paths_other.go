@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import "path/filepath"
+
+// localPath maps an S3 key to its location under localDir. Keys are used
+// as-is on Unix-like systems; see paths_windows.go for the Windows mapping.
+func localPath(localDir, key string) string {
+	return filepath.Join(localDir, key)
+}
@@ -0,0 +1,74 @@
+//go:build windows
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// maxPath is the classic Win32 MAX_PATH limit, including the trailing NUL.
+const maxPath = 260
+
+// reservedNames are device names Windows refuses as file names, with or
+// without an extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// localPath maps an S3 key to its location under localDir, rewriting each
+// "/"-separated component into a valid Windows file name and switching to
+// the \\?\ extended-length form when the result would exceed MAX_PATH.
+func localPath(localDir, key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = sanitizeWindowsName(part)
+	}
+	return longPath(filepath.Join(append([]string{localDir}, parts...)...))
+}
+
+// sanitizeWindowsName replaces characters Windows rejects in file names with
+// '_', strips the trailing dots and spaces it silently drops, and prefixes
+// reserved device names so they become ordinary files.
+func sanitizeWindowsName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 32 || strings.ContainsRune(`<>:"\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	trimmed := strings.TrimRight(name, ". ")
+	if trimmed != name && trimmed != "" {
+		name = trimmed + "_"
+	}
+
+	base := name
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if reservedNames[strings.ToUpper(base)] {
+		name = "_" + name
+	}
+	return name
+}
+
+// longPath returns path in \\?\ form when it is too long for the regular
+// Win32 APIs. Extended-length paths must be absolute, so the path is
+// resolved first; on failure it is returned unchanged.
+func longPath(path string) string {
+	if len(path) < maxPath || strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// inodesNeeded estimates how many inodes downloading keys into localDir
+// takes: one per file plus one per directory on the way to it. Directories
+// that already exist are counted too, so the estimate errs high.
+func inodesNeeded(localDir string, keys []string, tmpl *outputTemplate) uint64 {
+	root := filepath.Clean(localDir)
+	dirs := make(map[string]struct{})
+	var files uint64
+	for _, key := range keys {
+		filePath, err := targetPath(localDir, key, tmpl)
+		if err != nil {
+			continue
+		}
+		files++
+		for dir := filepath.Dir(filePath); dir != root && len(dir) > len(root); dir = filepath.Dir(dir) {
+			if _, seen := dirs[dir]; seen {
+				break
+			}
+			dirs[dir] = struct{}{}
+		}
+	}
+	return files + uint64(len(dirs))
+}
+
+// checkInodes compares the inodes the download needs against those free on
+// localDir's filesystem. It warns when they would run out, and fails when
+// fewer than minFree would be left afterwards and minFree is positive.
+func checkInodes(logger *log.Logger, localDir string, keys []string, tmpl *outputTemplate, minFree uint64) error {
+	free, ok, err := freeInodes(localDir)
+	if err != nil {
+		logger.Printf("Warning: could not check free inodes on %s: %v", localDir, err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	need := inodesNeeded(localDir, keys, tmpl)
+	if minFree > 0 && (free < need || free-need < minFree) {
+		return fmt.Errorf("%s has %d free inodes; downloading needs about %d and -min-free-inodes wants %d left over", localDir, free, need, minFree)
+	}
+	if free < need {
+		logger.Printf("Warning: %s has only %d free inodes, but downloading needs about %d", localDir, free, need)
+	}
+	return nil
+}
+
+// Open file descriptors a run needs besides its downloads: stdio, the log
+// file, manifests, the merge output and the like.
+const fdHeadroom = 32
+
+// fdsPerDownload is the most descriptors one download holds: its local
+// file and a connection for each part the transfer manager fetches at once.
+const fdsPerDownload = 1 + manager.DefaultDownloadConcurrency
+
+// fitOpenFiles makes sure maxConcurrency downloads, plus other descriptors
+// used elsewhere, fit under the soft RLIMIT_NOFILE. It first tries to raise
+// the soft limit towards the hard one; failing that, it lowers the
+// concurrency bounds to what fits and says how to lift the limit. It fails
+// only when not even one download fits. Platforms without the limit are
+// left alone.
+func fitOpenFiles(logger *log.Logger, minConcurrency, maxConcurrency, other int) (int, int, error) {
+	soft, hard, ok, err := openFileLimit()
+	if err != nil {
+		logger.Printf("Warning: could not check the open file limit: %v", err)
+		return minConcurrency, maxConcurrency, nil
+	}
+	if !ok {
+		return minConcurrency, maxConcurrency, nil
+	}
+	reserved := uint64(other + fdHeadroom)
+	need := uint64(maxConcurrency*fdsPerDownload) + reserved
+	if soft >= need {
+		return minConcurrency, maxConcurrency, nil
+	}
+	if target := min(need, hard); target > soft {
+		if err := raiseOpenFileLimit(target); err == nil {
+			logger.Printf("Raised the open file limit from %d to %d", soft, target)
+			soft = target
+		} else {
+			logger.Printf("Warning: could not raise the open file limit from %d to %d: %v", soft, target, err)
+		}
+		if soft >= need {
+			return minConcurrency, maxConcurrency, nil
+		}
+	}
+
+	fit := 0
+	if soft > reserved {
+		fit = int((soft - reserved) / fdsPerDownload)
+	}
+	if fit < 1 {
+		return 0, 0, fmt.Errorf("the open file limit of %d leaves no room for a single download; raise it with 'ulimit -n %d' or lower the other worker counts", soft, need)
+	}
+	logger.Printf("Warning: %d concurrent downloads need about %d open files, but the limit is %d; lowering -max-concurrency to %d. Raise the limit with 'ulimit -n %d' to keep %d", maxConcurrency, need, soft, fit, need, maxConcurrency)
+	return min(minConcurrency, fit), fit, nil
+}
+
+// explainEmptyListing tells apart the two reasons a listing can come back
+// empty: nothing at all under the prefixes, as with a mistyped prefix, or
+// objects that the suffix and listing filters all left out. It costs one
+// single-key ListObjectsV2 per prefix, stopping at the first hit.
+func explainEmptyListing(ctx context.Context, svc *s3.Client, bucket string, prefixes []string) (string, error) {
+	for _, prefix := range prefixes {
+		out, err := svc.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:  aws.String(bucket),
+			Prefix:  aws.String(prefix),
+			MaxKeys: aws.Int32(1),
+		})
+		if err != nil {
+			return "", fmt.Errorf("check for objects under %q: %w", prefix, err)
+		}
+		if len(out.Contents) > 0 {
+			return fmt.Sprintf("objects exist under s3://%s/%s (e.g. %s), but none matched the %s suffix or the listing filters; see -include-non-matching", bucket, prefix, aws.ToString(out.Contents[0].Key), matchSuffix), nil
+		}
+	}
+	return fmt.Sprintf("there are no objects at all under s3://%s/%s; check the bucket and prefix for typos", bucket, strings.Join(prefixes, ", ")), nil
+}
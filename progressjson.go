@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// progressEvent is one line of the -progress-json stream. Fields are only
+// ever added, so consumers can rely on the existing ones.
+type progressEvent struct {
+	Time        time.Time `json:"time"`
+	Bucket      string    `json:"bucket"`
+	FilesDone   int       `json:"files_done"`
+	FilesFailed int       `json:"files_failed"`
+	FilesTotal  int       `json:"files_total"`
+	BytesDone   int64     `json:"bytes_done"`
+	BytesTotal  int64     `json:"bytes_total"`
+	// RateBytesPerSec is measured over the interval since the previous
+	// event. ETASeconds is null until there is a rate to go by.
+	RateBytesPerSec float64  `json:"rate_bytes_per_sec"`
+	ETASeconds      *float64 `json:"eta_seconds"`
+	Done            bool     `json:"done"`
+}
+
+// progressStream writes a progressEvent for a bucket's downloads every
+// interval, and a last one with Done set when it is stopped. A finished
+// file counts as done or failed; done files add the size they were listed
+// with to the bytes done, failed ones add nothing.
+type progressStream struct {
+	enc    *json.Encoder
+	bucket string
+	sizes  map[string]int64
+
+	mu         sync.Mutex
+	event      progressEvent
+	lastBytes  int64
+	lastTime   time.Time
+	stopTicker chan struct{}
+	stopped    sync.WaitGroup
+	err        error
+}
+
+// progressWriter serializes events from every progressStream of a run onto
+// one writer.
+type progressWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.w.Write(b)
+}
+
+func startProgressStream(w *progressWriter, bucket string, objects []types.Object, interval time.Duration) *progressStream {
+	s := &progressStream{
+		enc:        json.NewEncoder(w),
+		bucket:     bucket,
+		sizes:      make(map[string]int64, len(objects)),
+		lastTime:   time.Now(),
+		stopTicker: make(chan struct{}),
+	}
+	s.event.Bucket = bucket
+	s.event.FilesTotal = len(objects)
+	for _, obj := range objects {
+		size := aws.ToInt64(obj.Size)
+		s.sizes[aws.ToString(obj.Key)] = size
+		s.event.BytesTotal += size
+	}
+
+	s.stopped.Add(1)
+	go func() {
+		defer s.stopped.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.emit(false)
+			case <-s.stopTicker:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// hook has the shape of downloadOptions.onComplete.
+func (s *progressStream) hook(key, _ string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil && !errors.Is(err, errDuplicate) {
+		s.event.FilesFailed++
+		return
+	}
+	s.event.FilesDone++
+	s.event.BytesDone += s.sizes[key]
+}
+
+func (s *progressStream) emit(done bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	e := s.event
+	e.Time = now
+	e.Done = done
+	if elapsed := now.Sub(s.lastTime).Seconds(); elapsed > 0 {
+		e.RateBytesPerSec = float64(e.BytesDone-s.lastBytes) / elapsed
+	}
+	if e.RateBytesPerSec > 0 {
+		eta := float64(e.BytesTotal-e.BytesDone) / e.RateBytesPerSec
+		e.ETASeconds = &eta
+	}
+	s.lastBytes, s.lastTime = e.BytesDone, now
+
+	if err := s.enc.Encode(e); err != nil && s.err == nil {
+		s.err = err
+	}
+}
+
+// stop emits the final event and returns the first write error.
+func (s *progressStream) stop() error {
+	close(s.stopTicker)
+	s.stopped.Wait()
+	s.emit(true)
+	return s.err
+}
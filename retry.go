@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// retryFailures downloads the objects in the -retry failures file again
+// instead of listing, for up to opts.retryRounds rounds with a doubling wait
+// between them. The file is rewritten after every round with whatever still
+// failed, so an interrupted retry, or a later one, carries on from there.
+func retryFailures(ctx context.Context, svc *s3.Client, opts options) error {
+	logger := opts.logger
+
+	pending, err := readManifest(opts.retryFrom)
+	if err != nil {
+		return err
+	}
+
+	// Files left behind by a failed attempt may be truncated, so never keep
+	// them.
+	dl := opts.download
+	dl.onExisting = onExistingOverwrite
+	var deleter *objectDeleter
+	if opts.deleteAfter {
+		deleter = newObjectDeleter(ctx, logger, svc, opts.bucket)
+		dl.addOnComplete(deleter.hook)
+	}
+
+	wait := opts.retryBackoff
+	round := 0
+	for len(pending) > 0 && round < opts.retryRounds {
+		round++
+		if round > 1 {
+			logger.Printf("%d files still failing, waiting %s before round %d", len(pending), wait, round)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return errors.New("interrupted, skipping decompression")
+			}
+			wait *= 2
+		}
+
+		keys := make([]string, 0, len(pending))
+		objects := make([]types.Object, 0, len(pending))
+		for key, etag := range pending {
+			keys = append(keys, key)
+			objects = append(objects, types.Object{Key: aws.String(key), ETag: aws.String(etag)})
+		}
+		sort.Strings(keys)
+
+		if tmpl := dl.template; tmpl != nil && tmpl.needsMetadata() {
+			if err := tmpl.loadMetadata(ctx, logger, svc, opts.bucket, objects, opts.headWorkers); err != nil {
+				logger.Printf("Failed to read some object metadata: %v", err)
+			}
+		}
+
+		// Write the new list beside the old one and swap it in, so the
+		// file is never left half-written.
+		tmp := opts.retryFrom + ".tmp"
+		failures, err := newFailuresWriter(tmp, objects)
+		if err != nil {
+			return err
+		}
+		roundOpts := dl
+		roundOpts.addOnComplete(failures.add)
+		if opts.summary != nil {
+			opts.summary.addObjects(opts.bucket, objects)
+			roundOpts.addOnComplete(opts.summary.hook(opts.bucket))
+		}
+
+		logger.Printf("Retry round %d of %d: %d files", round, opts.retryRounds, len(keys))
+		_ = downloadFiles(ctx, logger, svc, opts.bucket, opts.localDir, keys, roundOpts)
+		if err := failures.close(); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		if err := os.Rename(tmp, opts.retryFrom); err != nil {
+			return fmt.Errorf("update failures file: %w", err)
+		}
+		if ctx.Err() != nil {
+			return errors.New("interrupted, skipping decompression")
+		}
+		if pending, err = readManifest(opts.retryFrom); err != nil {
+			return err
+		}
+	}
+
+	var errs []error
+	if deleter != nil {
+		if err := deleter.finish(opts.summary); err != nil {
+			errs = append(errs, fmt.Errorf("some deletions failed: %w", err))
+		}
+	}
+	if len(pending) > 0 {
+		errs = append(errs, fmt.Errorf("%d files still failing after %d rounds, listed in %s", len(pending), round, opts.retryFrom))
+	} else {
+		logger.Printf("No failed files left in %s after %d rounds", opts.retryFrom, round)
+	}
+	if opts.download.rangeBytes > 0 {
+		logger.Printf("Skipping decompression: -range-bytes only fetched the start of each object")
+	} else {
+		logger.Printf("Decompressing %s files...", matchSuffix)
+		if err := decompressGzipFiles(logger, opts.localDir, opts.decompress); err != nil {
+			errs = append(errs, fmt.Errorf("decompress files: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// isRetryable reports whether a failed download is worth attempting again
+// within the same run: a stall, or content that arrived corrupted.
+func isRetryable(err error) bool {
+	return errors.Is(err, errStalled) || errors.Is(err, errChecksumMismatch)
+}
+
+// retryBudget counts the download retries of a whole run, and with a limit,
+// refuses any more once that many have been made, so a broadly unhealthy
+// backend fails the run promptly instead of every download retrying in
+// turn.
+type retryBudget struct {
+	limit int
+	used  atomic.Int64
+	// once logs the first refusal.
+	once sync.Once
+}
+
+// newRetryBudget returns a budget of limit retries, or an unlimited one
+// that only counts them when limit is 0.
+func newRetryBudget(limit int) *retryBudget {
+	return &retryBudget{limit: limit}
+}
+
+// take claims one retry, reporting false once the budget is spent. The
+// first refusal is logged.
+func (b *retryBudget) take(logger *log.Logger) bool {
+	if b == nil {
+		return true
+	}
+	if n := b.used.Add(1); b.limit > 0 && n > int64(b.limit) {
+		b.used.Add(-1)
+		b.once.Do(func() {
+			logger.Printf("Retry budget of %d spent; failed downloads are no longer retried", b.limit)
+		})
+		return false
+	}
+	return true
+}
+
+// Jitter modes for -retry-jitter; see backoff.delay.
+const (
+	jitterFull  = "full"
+	jitterEqual = "equal"
+	jitterNone  = "none"
+)
+
+// backoff is the schedule the download retry loop waits on: base,
+// multiplied by multiplier after every failed attempt, capped at max, then
+// jittered.
+type backoff struct {
+	base       time.Duration
+	max        time.Duration
+	multiplier float64
+	jitter     string
+}
+
+// defaultBackoff follows the AWS guidance on exponential backoff: doubling
+// from one second, capped at 20 seconds, with full jitter so retries from
+// many workers don't arrive in lockstep.
+var defaultBackoff = backoff{
+	base:       time.Second,
+	max:        20 * time.Second,
+	multiplier: 2,
+	jitter:     jitterFull,
+}
+
+func (b backoff) validate() error {
+	switch {
+	case b.base <= 0:
+		return fmt.Errorf("-retry-base %s must be positive", b.base)
+	case b.max < b.base:
+		return fmt.Errorf("-retry-max %s must be at least -retry-base %s", b.max, b.base)
+	case b.multiplier < 1 || math.IsInf(b.multiplier, 0) || math.IsNaN(b.multiplier):
+		return fmt.Errorf("-retry-multiplier %g must be at least 1", b.multiplier)
+	}
+	switch b.jitter {
+	case jitterFull, jitterEqual, jitterNone:
+		return nil
+	}
+	return fmt.Errorf("-retry-jitter %q must be %s, %s or %s", b.jitter, jitterFull, jitterEqual, jitterNone)
+}
+
+// delay is how long to wait before retrying a download that has already
+// failed attempt+1 times. Full jitter picks uniformly between zero and the
+// capped delay, equal jitter between half of it and all of it.
+func (b backoff) delay(attempt int) time.Duration {
+	d := float64(b.max)
+	if exp := float64(b.base) * math.Pow(b.multiplier, float64(attempt)); exp < d {
+		d = exp
+	}
+	switch b.jitter {
+	case jitterFull:
+		d = rand.Float64() * d
+	case jitterEqual:
+		d = d/2 + rand.Float64()*d/2
+	}
+	return time.Duration(d)
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// openFileLimit is not supported here; see rlimit_unix.go.
+func openFileLimit() (soft, hard uint64, ok bool, err error) {
+	return 0, 0, false, nil
+}
+
+func raiseOpenFileLimit(n uint64) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,25 @@
+//go:build linux || darwin
+
+package main
+
+import "syscall"
+
+// openFileLimit reports the soft and hard limits on open file descriptors.
+func openFileLimit() (soft, hard uint64, ok bool, err error) {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return 0, 0, false, err
+	}
+	return uint64(lim.Cur), uint64(lim.Max), true, nil
+}
+
+// raiseOpenFileLimit sets the soft limit on open file descriptors to n,
+// which must not exceed the hard limit.
+func raiseOpenFileLimit(n uint64) error {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return err
+	}
+	lim.Cur = n
+	return syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lim)
+}
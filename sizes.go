@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// sizeNode is one prefix in the -sizes tree, or one directory in the
+// -print-tree tree, with the cumulative size and object count of everything
+// beneath it. In -print-tree files are nodes too.
+type sizeNode struct {
+	name     string
+	bytes    int64
+	objects  int
+	file     bool
+	children map[string]*sizeNode
+}
+
+func (n *sizeNode) child(name string) *sizeNode {
+	if n.children == nil {
+		n.children = make(map[string]*sizeNode)
+	}
+	c, ok := n.children[name]
+	if !ok {
+		c = &sizeNode{name: name}
+		n.children[name] = c
+	}
+	return c
+}
+
+// printSizeTree writes cumulative sizes for objects grouped by the first
+// depth directory levels below prefix. Levels are counted from the last "/"
+// in prefix, so both "a/b" and "a/b/" group by the directories under "a/b".
+func printSizeTree(w io.Writer, objects []types.Object, prefix string, depth int) {
+	base := prefix[:strings.LastIndex(prefix, "/")+1]
+	root := &sizeNode{name: base}
+	if root.name == "" {
+		root.name = "/"
+	}
+
+	for _, obj := range objects {
+		size := aws.ToInt64(obj.Size)
+		dirs := strings.Split(strings.TrimPrefix(aws.ToString(obj.Key), base), "/")
+		dirs = dirs[:len(dirs)-1] // drop the file name
+
+		node := root
+		node.bytes += size
+		node.objects++
+		for i := 0; i < len(dirs) && i < depth; i++ {
+			node = node.child(dirs[i] + "/")
+			node.bytes += size
+			node.objects++
+		}
+	}
+
+	writeSizeNode(w, root, 0, "objects")
+}
+
+// printLocalTree writes the directories and files under root as a tree with
+// the size of every file and the cumulative size and file count of every
+// directory, down to depth levels below root (0 shows every level).
+func printLocalTree(w io.Writer, root string, depth int) error {
+	top := &sizeNode{name: filepath.Clean(root) + string(filepath.Separator)}
+	// Nothing decompressed means no -decompress-dir-out either.
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		writeSizeNode(w, top, 0, "files")
+		return nil
+	}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		var size int64
+		if !info.IsDir() {
+			size = info.Size()
+			top.bytes += size
+			top.objects++
+		}
+		node := top
+		for i, part := range parts {
+			if depth > 0 && i >= depth {
+				break
+			}
+			last := i == len(parts)-1
+			if !last || info.IsDir() {
+				part += "/"
+			}
+			node = node.child(part)
+			node.file = last && !info.IsDir()
+			if !info.IsDir() {
+				node.bytes += size
+				node.objects++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	writeSizeNode(w, top, 0, "files")
+	return nil
+}
+
+// writeSizeNode writes n and everything below it, its objects counted as
+// noun.
+func writeSizeNode(w io.Writer, n *sizeNode, indent int, noun string) {
+	name := strings.Repeat("  ", indent) + n.name
+	if n.file {
+		fmt.Fprintf(w, "%-*s%10s\n", 40, name, formatBytes(n.bytes))
+	} else {
+		fmt.Fprintf(w, "%-*s%10s  %d %s\n", 40, name, formatBytes(n.bytes), n.objects, noun)
+	}
+
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeSizeNode(w, n.children[name], indent+1, noun)
+	}
+}
+
+// formatBytes renders n using binary units, e.g. "1.5 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// chunkPath returns the name of chunk n of outputPath for -split-records:
+// file.json becomes file.part0.json, file.part1.json and so on.
+func chunkPath(outputPath string, n int) string {
+	ext := filepath.Ext(outputPath)
+	return fmt.Sprintf("%s.part%d%s", strings.TrimSuffix(outputPath, ext), n, ext)
+}
+
+// recordSplitter writes NDJSON into chunk files of at most limit records
+// each, counting records by their terminating newline. A new chunk is only
+// started once data follows a full one, so no chunk is ever empty unless
+// the whole input is.
+type recordSplitter struct {
+	outputPath string
+	limit      int
+	checksums  bool
+	// sync fsyncs each chunk as it is closed.
+	sync bool
+	// compress, for -output-gzip, gzips each chunk at level and adds .gz
+	// to its name.
+	compress bool
+	level    int
+
+	cur     *os.File
+	gz      *gzip.Writer
+	w       io.Writer
+	sum     hash.Hash
+	records int
+	chunks  []string
+	sums    [][]byte
+	// temps are the temporary files chunks are written to, renamed to
+	// their chunk names once every chunk is complete.
+	temps []string
+}
+
+func (s *recordSplitter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if s.cur == nil || s.records == s.limit {
+			if err := s.next(); err != nil {
+				return written, err
+			}
+		}
+		n := len(p)
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			n = i + 1
+			s.records++
+		}
+		if _, err := s.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// next closes the current chunk, if any, and starts the following one.
+func (s *recordSplitter) next() error {
+	if err := s.closeChunk(); err != nil {
+		return err
+	}
+	path := s.chunkPath(len(s.chunks))
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create output file: %w", err)
+	}
+	s.cur, s.w, s.records = f, f, 0
+	s.chunks = append(s.chunks, path)
+	s.temps = append(s.temps, f.Name())
+	if s.checksums {
+		s.sum = sha256.New()
+		s.w = io.MultiWriter(f, s.sum)
+	}
+	if s.compress {
+		if s.gz, err = newOutputGzip(s.w, s.level); err != nil {
+			return fmt.Errorf("create gzip writer: %w", err)
+		}
+		s.w = s.gz
+	}
+	return nil
+}
+
+// chunkPath is the name of chunk n.
+func (s *recordSplitter) chunkPath(n int) string {
+	path := chunkPath(s.outputPath, n)
+	if s.compress {
+		path += ".gz"
+	}
+	return path
+}
+
+func (s *recordSplitter) closeChunk() error {
+	if s.cur == nil {
+		return nil
+	}
+	var err error
+	if s.gz != nil {
+		err = s.gz.Close()
+		s.gz = nil
+	}
+	if s.sync && err == nil {
+		err = s.cur.Sync()
+	}
+	if cerr := s.cur.Close(); err == nil {
+		err = cerr
+	}
+	s.cur = nil
+	if err != nil {
+		return fmt.Errorf("close %s: %w", s.chunks[len(s.chunks)-1], err)
+	}
+	if s.sum != nil {
+		s.sums = append(s.sums, s.sum.Sum(nil))
+	}
+	return nil
+}
+
+// splitRecords writes the decompressed content of gz into chunks of
+// outputPath with at most opts.splitRecords records each, closes gz, and
+// returns the chunk paths. Chunks only get their names once all of them
+// are complete, the first one last, so a first chunk on disk means a whole
+// set; on failure every chunk written is removed again.
+// Higher-numbered chunks left over from an earlier run that produced more
+// of them are removed too, so the chunks on disk are exactly this run's.
+func splitRecords(gz io.ReadCloser, outputPath string, opts decompressOptions) ([]string, error) {
+	s := &recordSplitter{outputPath: outputPath, limit: opts.splitRecords, checksums: opts.checksums != nil, sync: opts.syncOutput,
+		compress: opts.outputGzip, level: opts.gzipLevel}
+	_, err := io.Copy(s, gz)
+	if err == nil && s.cur == nil {
+		// Empty input still gets its one (empty) chunk.
+		err = s.next()
+	}
+	if err != nil {
+		err = fmt.Errorf("write %s: %w", outputPath, err)
+	}
+	if cerr := gz.Close(); cerr != nil && err == nil {
+		err = fmt.Errorf("close gzip stream: %w", cerr)
+	}
+	if cerr := s.closeChunk(); cerr != nil && err == nil {
+		err = cerr
+	}
+	for i := len(s.temps) - 1; i >= 0 && err == nil; i-- {
+		if rerr := os.Rename(s.temps[i], s.chunks[i]); rerr != nil {
+			err = fmt.Errorf("rename %s: %w", s.chunks[i], rerr)
+		}
+	}
+	if err != nil {
+		for i := range s.chunks {
+			os.Remove(s.temps[i])
+			os.Remove(s.chunks[i])
+		}
+		return nil, err
+	}
+
+	if opts.checksums != nil {
+		for i, path := range s.chunks {
+			opts.checksums.add(path, s.sums[i])
+		}
+	}
+	for n := len(s.chunks); ; n++ {
+		if err := os.Remove(s.chunkPath(n)); err != nil {
+			break
+		}
+	}
+	return s.chunks, nil
+}
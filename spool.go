@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// spoolFlushSize is how many bytes of records keySpool collects before
+// writing them out.
+const spoolFlushSize = 64 << 10
+
+// keySpool is an on-disk queue of listed objects for -key-spool-dir: the
+// listing appends to it as fast as it goes and the downloads read from it
+// as fast as they go, so however far the listing gets ahead, the keys in
+// between cost disk instead of memory. Each record is the key's length as a
+// uvarint, the key, and the object's size as a varint, so keys may hold any
+// byte.
+type keySpool struct {
+	file *os.File
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+	// written counts the bytes in the file, always whole records.
+	written int64
+	closed  bool
+	err     error
+}
+
+func newKeySpool(dir string) (*keySpool, error) {
+	f, err := os.CreateTemp(dir, "s3downloader-keys-*.spool")
+	if err != nil {
+		return nil, fmt.Errorf("create key spool: %w", err)
+	}
+	s := &keySpool{file: f}
+	s.cond = sync.NewCond(&s.mu)
+	return s, nil
+}
+
+// add queues one object. Records reach the file, and the reader, in
+// batches of spoolFlushSize bytes, or at the next endPage.
+func (s *keySpool) add(key string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buf = binary.AppendUvarint(s.buf, uint64(len(key)))
+	s.buf = append(s.buf, key...)
+	s.buf = binary.AppendVarint(s.buf, size)
+	if len(s.buf) >= spoolFlushSize {
+		s.flush()
+	}
+}
+
+// endPage writes out what the listing page just added, so a page that
+// falls short of a batch doesn't wait on the next one to be downloaded.
+func (s *keySpool) endPage() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flush()
+}
+
+// flush writes out the collected records and wakes the reader. s.mu must
+// be held.
+func (s *keySpool) flush() {
+	if s.err == nil && len(s.buf) > 0 {
+		n, err := s.file.Write(s.buf)
+		s.written += int64(n)
+		if err != nil {
+			s.err = fmt.Errorf("write key spool: %w", err)
+		}
+	}
+	s.buf = s.buf[:0]
+	s.cond.Broadcast()
+}
+
+// close ends the queue once the listing is done; drain returns after
+// reading what is left.
+func (s *keySpool) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flush()
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+// drain calls fn with every queued object in order, waiting for more until
+// the queue is closed, then removes the spool file. fn may block, which
+// holds back the reading but never the listing.
+func (s *keySpool) drain(fn func(key string, size int64)) error {
+	defer func() {
+		s.file.Close()
+		os.Remove(s.file.Name())
+	}()
+	r, err := os.Open(s.file.Name())
+	if err != nil {
+		return fmt.Errorf("read key spool: %w", err)
+	}
+	defer r.Close()
+
+	var read int64
+	br := bufio.NewReaderSize(nil, spoolFlushSize)
+	for {
+		s.mu.Lock()
+		for read == s.written && !s.closed && s.err == nil {
+			s.cond.Wait()
+		}
+		avail, closed, werr := s.written, s.closed, s.err
+		s.mu.Unlock()
+		if werr != nil {
+			return werr
+		}
+		if read == avail && closed {
+			return nil
+		}
+
+		// Only read up to what is known to be written: a write still in
+		// progress may be partly visible.
+		br.Reset(io.NewSectionReader(r, read, avail-read))
+		for {
+			n, err := binary.ReadUvarint(br)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("read key spool: %w", err)
+			}
+			key := make([]byte, n)
+			if _, err := io.ReadFull(br, key); err != nil {
+				return fmt.Errorf("read key spool: %w", err)
+			}
+			size, err := binary.ReadVarint(br)
+			if err != nil {
+				return fmt.Errorf("read key spool: %w", err)
+			}
+			fn(string(key), size)
+		}
+		read = avail
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeySpoolEndPageReachesReader(t *testing.T) {
+	s, err := newKeySpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan string, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.drain(func(key string, _ int64) { got <- key })
+	}()
+
+	s.add("data/a.json.gz", 10)
+	s.endPage()
+	select {
+	case key := <-got:
+		if key != "data/a.json.gz" {
+			t.Errorf("drained %q, want data/a.json.gz", key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a page shorter than a batch never reached the reader")
+	}
+	s.close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkStreamBucket runs -concurrent-list-and-download against a stub
+// S3 whose listing outpaces the downloads, once with the listed keys queued
+// in memory and once with -key-spool-dir, and reports the peak heap seen
+// while each run was going.
+func BenchmarkStreamBucket(b *testing.B) {
+	const pages, perPage = 10, 500
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("{\"a\":1}\n"))
+	gz.Close()
+	body := buf.Bytes()
+	sum := crc32.ChecksumIEEE(body)
+	checksum := base64.StdEncoding.EncodeToString([]byte{byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("list-type") != "2" {
+			time.Sleep(time.Millisecond)
+			w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+			w.Header().Set("ETag", `"e"`)
+			w.Header().Set("X-Amz-Checksum-Crc32", checksum)
+			w.Write(body)
+			return
+		}
+		page := 0
+		fmt.Sscan(r.URL.Query().Get("continuation-token"), &page)
+		var b bytes.Buffer
+		b.WriteString(`<?xml version="1.0" encoding="UTF-8"?><ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>bucket</Name>`)
+		if page+1 < pages {
+			fmt.Fprintf(&b, `<IsTruncated>true</IsTruncated><NextContinuationToken>%d</NextContinuationToken>`, page+1)
+		} else {
+			b.WriteString(`<IsTruncated>false</IsTruncated>`)
+		}
+		for i := range perPage {
+			fmt.Fprintf(&b, `<Contents><Key>miner_data/2025/10/20/%02d/part-%06d.json.gz</Key><Size>%d</Size><ETag>"e"</ETag></Contents>`, page, page*perPage+i, len(body))
+		}
+		b.WriteString(`</ListBucketResult>`)
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(b.Bytes())
+	}))
+	b.Cleanup(srv.Close)
+
+	for _, spool := range []bool{false, true} {
+		name := "memory"
+		if spool {
+			name = "spool"
+		}
+		b.Run(name, func(b *testing.B) {
+			var peak uint64
+			for b.Loop() {
+				args := []string{
+					"-bucket", "bucket", "-prefix", "miner_data/", "-out", b.TempDir(),
+					"-endpoint", srv.URL, "-region", "us-east-1",
+					"-access-key", "AKID", "-secret-key", "SECRET",
+					"-concurrent-list-and-download",
+					"-log-file", filepath.Join(b.TempDir(), "log"),
+				}
+				if spool {
+					args = append(args, "-key-spool-dir", b.TempDir())
+				}
+				opts, err := parseOptions(args)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				runtime.GC()
+				stop := make(chan struct{})
+				var wg sync.WaitGroup
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					var m runtime.MemStats
+					tick := time.NewTicker(5 * time.Millisecond)
+					defer tick.Stop()
+					for {
+						runtime.ReadMemStats(&m)
+						peak = max(peak, m.HeapAlloc)
+						select {
+						case <-stop:
+							return
+						case <-tick.C:
+						}
+					}
+				}()
+				err = run(context.Background(), opts)
+				close(stop)
+				wg.Wait()
+				for _, c := range opts.closers {
+					c.Close()
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(peak), "peak-heap-B")
+		})
+	}
+}
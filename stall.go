@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// errStalled marks a download cancelled for trickling in too slowly. It is
+// retryable: a fresh connection usually goes at full speed again.
+var errStalled = errors.New("download stalled")
+
+// downloadTarget is what a download writes to: the transfer manager uses
+// WriteAt, ranged GetObjects plain Write.
+type downloadTarget interface {
+	io.Writer
+	io.WriterAt
+}
+
+// countingTarget counts the bytes written through it.
+type countingTarget struct {
+	downloadTarget
+	n atomic.Int64
+}
+
+func (c *countingTarget) Write(p []byte) (int, error) {
+	n, err := c.downloadTarget.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func (c *countingTarget) WriteAt(p []byte, off int64) (int, error) {
+	n, err := c.downloadTarget.WriteAt(p, off)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// watchStalls wraps w so that the returned context is cancelled with
+// errStalled as soon as fewer than minRate bytes per second were written
+// through it over a whole window. stop ends the watch and must be called
+// once the download returns.
+func watchStalls(ctx context.Context, w downloadTarget, minRate int64, window time.Duration) (context.Context, downloadTarget, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	counted := &countingTarget{downloadTarget: w}
+	minBytes := int64(float64(minRate) * window.Seconds())
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+		var last int64
+		for {
+			select {
+			case <-ticker.C:
+				n := counted.n.Load()
+				if n-last < minBytes {
+					cancel(errStalled)
+					return
+				}
+				last = n
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ctx, counted, func() {
+		close(done)
+		cancel(nil)
+	}
+}
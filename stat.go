@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// objectStat is what -stat reports about one object, and the JSON it
+// writes to -summary-json.
+type objectStat struct {
+	Bucket          string            `json:"bucket"`
+	Key             string            `json:"key"`
+	Size            int64             `json:"size"`
+	ETag            string            `json:"etag"`
+	LastModified    time.Time         `json:"last_modified"`
+	StorageClass    string            `json:"storage_class"`
+	ContentType     string            `json:"content_type,omitempty"`
+	ContentEncoding string            `json:"content_encoding,omitempty"`
+	VersionID       string            `json:"version_id,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}
+
+// statTarget splits a -stat argument into bucket and key: either an
+// s3://bucket/key URL or a key in defaultBucket.
+func statTarget(arg, defaultBucket string) (bucket, key string, err error) {
+	bucket, key = defaultBucket, arg
+	if strings.HasPrefix(arg, "s3://") {
+		if bucket, key, err = parseS3URL(arg); err != nil {
+			return "", "", err
+		}
+	}
+	if key == "" {
+		return "", "", fmt.Errorf("-stat %q names no key", arg)
+	}
+	return bucket, key, nil
+}
+
+// statObject issues one HeadObject for opts.stat and prints the metadata,
+// downloading nothing. With -summary-json it is written there as JSON
+// instead.
+func statObject(ctx context.Context, svc *s3.Client, opts options) error {
+	bucket, key, err := statTarget(opts.stat, opts.bucket)
+	if err != nil {
+		return err
+	}
+	out, err := svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("head s3://%s/%s: %w", bucket, key, err)
+	}
+
+	st := objectStat{
+		Bucket:          bucket,
+		Key:             key,
+		Size:            aws.ToInt64(out.ContentLength),
+		ETag:            aws.ToString(out.ETag),
+		LastModified:    aws.ToTime(out.LastModified),
+		StorageClass:    string(out.StorageClass),
+		ContentType:     aws.ToString(out.ContentType),
+		ContentEncoding: aws.ToString(out.ContentEncoding),
+		VersionID:       aws.ToString(out.VersionId),
+		Metadata:        out.Metadata,
+	}
+	// S3 leaves the header out for the default class.
+	if st.StorageClass == "" {
+		st.StorageClass = "STANDARD"
+	}
+
+	if opts.summaryJSON == "" {
+		return printStat(os.Stdout, st)
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if opts.summaryJSON == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = writeFileAtomic(opts.summaryJSON, data)
+	}
+	if err != nil {
+		return fmt.Errorf("write stat: %w", err)
+	}
+	return nil
+}
+
+// printStat writes st as aligned name/value lines.
+func printStat(w io.Writer, st objectStat) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Object:\ts3://%s/%s\n", st.Bucket, st.Key)
+	fmt.Fprintf(tw, "Size:\t%s (%d bytes)\n", formatBytes(st.Size), st.Size)
+	fmt.Fprintf(tw, "ETag:\t%s\n", st.ETag)
+	fmt.Fprintf(tw, "Last modified:\t%s\n", st.LastModified.Format(time.RFC3339))
+	fmt.Fprintf(tw, "Storage class:\t%s\n", st.StorageClass)
+	if st.ContentType != "" {
+		fmt.Fprintf(tw, "Content type:\t%s\n", st.ContentType)
+	}
+	if st.ContentEncoding != "" {
+		fmt.Fprintf(tw, "Content encoding:\t%s\n", st.ContentEncoding)
+	}
+	if st.VersionID != "" {
+		fmt.Fprintf(tw, "Version ID:\t%s\n", st.VersionID)
+	}
+	names := make([]string, 0, len(st.Metadata))
+	for name := range st.Metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(tw, "Metadata %s:\t%s\n", name, st.Metadata[name])
+	}
+	return tw.Flush()
+}
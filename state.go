@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// runState is persisted between runs in the -state-file.
+type runState struct {
+	// LastModified is the newest LastModified among the objects selected by
+	// the last fully successful -since-last-run pass.
+	LastModified time.Time `json:"last_modified,omitzero"`
+	// Partitions are the s3://bucket/prefix partitions -only-new-partitions
+	// has completely downloaded.
+	Partitions []string `json:"partitions,omitempty"`
+	// Checkpoint is the progress -checkpoint-interval saved during a run
+	// that has not finished successfully yet.
+	Checkpoint *checkpoint `json:"checkpoint,omitempty"`
+}
+
+// loadState reads path. A missing file is an empty state, so the first run
+// behaves like a normal full run.
+func loadState(path string) (runState, error) {
+	var st runState
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, fmt.Errorf("read state file: %w", err)
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return st, fmt.Errorf("parse state file %s: %w", path, err)
+	}
+	return st, nil
+}
+
+// saveState writes st to path atomically, so an interrupted write never
+// leaves a truncated state file behind.
+func saveState(path string, st runState) error {
+	data, err := encodeState(st)
+	if err != nil {
+		return err
+	}
+	return writeState(path, data)
+}
+
+func encodeState(st runState) ([]byte, error) {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func writeState(path string, data []byte) error {
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("write state file: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to path through a temporary file in the same
+// directory and a rename, so readers see either the old or the new content.
+// The data is synced before the rename, so that holds after a crash too.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// watermark tracks the newest timestamp observed, safely across goroutines.
+type watermark struct {
+	mu     sync.Mutex
+	newest time.Time
+}
+
+func (w *watermark) observe(t time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if t.After(w.newest) {
+		w.newest = t
+	}
+}
+
+func (w *watermark) get() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.newest
+}
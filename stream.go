@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// streamBucket is runBucket for -concurrent-list-and-download: every
+// object is handed to the downloads as soon as it is listed, instead of
+// after the whole listing, so the first bytes arrive within a page of
+// starting. Options that need the full listing up front are refused by
+// main; so are keys that only differ by case, which can't be told apart
+// before every key is known, and are only warned about.
+func streamBucket(ctx context.Context, svc *s3.Client, opts options, state runState) error {
+	logger := opts.logger
+
+	if tmpl := opts.download.template; tmpl != nil && tmpl.needsMetadata() {
+		return errors.New("-concurrent-list-and-download cannot be combined with an -output-template that needs object metadata")
+	}
+	if opts.download.writesLocally() {
+		if insensitive, err := caseInsensitive(opts.localDir); err == nil && insensitive {
+			logger.Printf("Warning: %s is case-insensitive; with -concurrent-list-and-download, keys that differ only by case overwrite each other", opts.localDir)
+		}
+	}
+
+	opts.download.addOnComplete(opts.summary.hook(opts.bucket))
+	var pool *decompressPool
+	if opts.pipelineWorkers > 0 && opts.download.writesLocally() {
+		pool = startDecompressPool(logger, opts.pipelineWorkers, opts.decompress)
+		defer pool.stop()
+		opts.download.addOnComplete(pool.submit)
+	}
+	var deleter *objectDeleter
+	if opts.deleteAfter {
+		deleter = newObjectDeleter(ctx, logger, svc, opts.bucket)
+		opts.download.addOnComplete(deleter.hook)
+	}
+
+	// Only a few times the download concurrency are taken off the channel
+	// at once; once it is full, the listing waits for the downloads. With
+	// a spool, listed keys wait on disk instead, and the listing never does.
+	opts.download.maxPending = 2 * opts.download.maxConcurrency
+	var spool *keySpool
+	if opts.keySpoolDir != "" {
+		var err error
+		if spool, err = newKeySpool(opts.keySpoolDir); err != nil {
+			return err
+		}
+		opts.list.pageDone = spool.endPage
+	}
+
+	// Overlapping -prefix-file prefixes list some keys more than once, so
+	// every key is kept to drop the duplicates. Partitions of
+	// -only-new-partitions are distinct prefixes at one depth and never
+	// overlap, which keeps memory flat with -key-spool-dir.
+	dedupe := len(opts.prefixes) > 0 && opts.partitionDepth == 0
+	keys := make(chan string, maxListPageSize)
+	var found, unstripped atomic.Int64
+	tmpl := opts.download.template
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	opts.list.found = func(obj types.Object) {
+		key := aws.ToString(obj.Key)
+		if dedupe {
+			mu.Lock()
+			dup := seen[key]
+			seen[key] = true
+			mu.Unlock()
+			if dup {
+				return
+			}
+		}
+		if opts.maxObjectSize > 0 && oversized(logger, obj, opts.maxObjectSize) {
+			opts.summary.addTooLarge(1)
+			return
+		}
+		found.Add(1)
+		if tmpl != nil && tmpl.strip != "" {
+			if _, ok := tmpl.stripped(key); !ok {
+				unstripped.Add(1)
+			}
+		}
+		if spool != nil {
+			spool.add(key, aws.ToInt64(obj.Size))
+			return
+		}
+		opts.summary.addObjects(opts.bucket, []types.Object{obj})
+		keys <- key
+	}
+
+	if opts.warmConnections > 0 {
+		warmConnections(ctx, logger, svc, opts.bucket, opts.warmConnections, opts.list.verbose)
+	}
+
+	// With -fail-fast, the first failed download stops the listing, and so
+	// does a spool that can't be read any more.
+	listCtx, stopListing := context.WithCancelCause(ctx)
+	defer stopListing(nil)
+	if opts.download.failFast {
+		opts.download.addOnComplete(func(_, _ string, err error) {
+			if err != nil && !errors.Is(err, errDuplicate) {
+				stopListing(errFailFast)
+			}
+		})
+	}
+	listed := make(chan error, 1)
+	go func() {
+		if spool != nil {
+			defer spool.close()
+		} else {
+			defer close(keys)
+		}
+		_, err := listBucket(listCtx, svc, opts)
+		listed <- err
+	}()
+	drained := make(chan error, 1)
+	if spool != nil {
+		go func() {
+			defer close(keys)
+			err := spool.drain(func(key string, size int64) {
+				opts.summary.addObjects(opts.bucket, []types.Object{{Key: aws.String(key), Size: aws.Int64(size)}})
+				keys <- key
+			})
+			if err != nil {
+				stopListing(err)
+			}
+			drained <- err
+		}()
+	} else {
+		drained <- nil
+	}
+	// Download failures don't stop the run, and neither does a failed
+	// listing: what was found is still downloaded and decompressed.
+	downloadErr := downloadStream(ctx, logger, svc, opts.bucket, opts.localDir, keys, 0, nil, opts.download)
+	listErr := <-listed
+	if errors.Is(context.Cause(listCtx), errFailFast) {
+		// The failed download is already reported.
+		listErr = nil
+	}
+	if err := <-drained; err != nil {
+		listErr = errors.Join(listErr, err)
+	}
+	if ctx.Err() != nil {
+		return errors.New("interrupted, skipping decompression")
+	}
+	logger.Printf("Listed %d matching files while downloading", found.Load())
+	if n := unstripped.Load(); n > 0 {
+		logger.Printf("Warning: %d of %d keys didn't start with -strip-prefix %q and kept their full path", n, found.Load(), tmpl.strip)
+	}
+	if listErr == nil && found.Load() == 0 {
+		if err := reportEmptyListing(ctx, svc, opts); err != nil {
+			return err
+		}
+	}
+	if opts.download.writesLocally() {
+		if err := createMarkedDirs(logger, opts.localDir, opts.list.dirMarkers.list()); err != nil {
+			listErr = errors.Join(listErr, err)
+		}
+	}
+
+	if downloadErr != nil {
+		downloadErr = fmt.Errorf("some downloads failed: %w", downloadErr)
+	}
+	return finishBucket(opts, state, pool, deleter, errors.Join(listErr, downloadErr))
+}
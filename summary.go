@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// runSummary collects the outcome of every object in a run, across buckets
+// and -retry rounds; a later outcome for the same object replaces an
+// earlier one.
+type runSummary struct {
+	started time.Time
+
+	mu       sync.Mutex
+	sizes    map[objectID]int64
+	outcomes map[objectID]error
+	// compact tallies each outcome as it arrives instead of keeping it,
+	// so only objects still waiting for one are held in sizes, for runs
+	// too large to keep every key in memory. Outcomes can't be replaced
+	// then, so it is only for passes that try each object once.
+	compact bool
+	objects int
+	totals  summaryJSON
+	skipped []string
+	// deleted and deleteLocked count -delete-after deletions, and those
+	// skipped because of Object Lock.
+	deleted      int
+	deleteLocked int
+	// nextToken is where a -max-files listing stopped; nil unless the
+	// listing was paginated that way.
+	nextToken *string
+	// retries counts the download retries made, against -retry-budget.
+	retries *retryBudget
+	// tooLarge counts the objects -max-object-size skipped.
+	tooLarge int
+}
+
+type objectID struct {
+	bucket string
+	key    string
+}
+
+func newRunSummary() *runSummary {
+	return &runSummary{
+		started:  time.Now(),
+		sizes:    make(map[objectID]int64),
+		outcomes: make(map[objectID]error),
+	}
+}
+
+// newCompactSummary is newRunSummary with compact set.
+func newCompactSummary() *runSummary {
+	s := newRunSummary()
+	s.compact = true
+	s.totals.Failures = []summaryFailure{}
+	return s
+}
+
+// addObjects records the objects a bucket's pass is about to download.
+func (s *runSummary) addObjects(bucket string, objects []types.Object) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, obj := range objects {
+		id := objectID{bucket, aws.ToString(obj.Key)}
+		if _, ok := s.sizes[id]; !ok {
+			s.objects++
+		}
+		s.sizes[id] = aws.ToInt64(obj.Size)
+	}
+}
+
+// addSkippedPrefixes records prefixes left out of a bucket's listing.
+func (s *runSummary) addSkippedPrefixes(bucket string, prefixes []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, prefix := range prefixes {
+		s.skipped = append(s.skipped, "s3://"+bucket+"/"+prefix)
+	}
+}
+
+// addDeletions records the outcome of a bucket's -delete-after.
+func (s *runSummary) addDeletions(deleted, locked int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleted += deleted
+	s.deleteLocked += locked
+}
+
+// addTooLarge records n objects skipped for being over -max-object-size.
+func (s *runSummary) addTooLarge(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tooLarge += n
+}
+
+// setContinuationToken records the continuation token a bounded listing
+// stopped at, or "" when it reached the end of the prefix.
+func (s *runSummary) setContinuationToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextToken = &token
+}
+
+// hook returns a downloadOptions.onComplete hook recording outcomes for
+// bucket.
+func (s *runSummary) hook(bucket string) func(key, path string, err error) {
+	return func(key, _ string, err error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		id := objectID{bucket, key}
+		size, ok := s.sizes[id]
+		if !ok {
+			s.objects++
+		}
+		if s.compact {
+			delete(s.sizes, id)
+			s.totals.tally(id, size, err)
+			return
+		}
+		s.sizes[id] = size
+		s.outcomes[id] = err
+	}
+}
+
+// summaryJSON is the -summary-json document. Fields are only ever added, so
+// consumers can rely on the existing ones.
+type summaryJSON struct {
+	Started         time.Time        `json:"started"`
+	Finished        time.Time        `json:"finished"`
+	DurationSeconds float64          `json:"duration_seconds"`
+	Objects         int              `json:"objects"`
+	Completed       int              `json:"completed"`
+	Duplicates      int              `json:"duplicates"`
+	Failed          int              `json:"failed"`
+	NotAttempted    int              `json:"not_attempted"`
+	Bytes           int64            `json:"bytes"`
+	SkippedPrefixes []string         `json:"skipped_prefixes"`
+	Failures        []summaryFailure `json:"failures"`
+	Error           string           `json:"error,omitempty"`
+	Deleted         int              `json:"deleted"`
+	DeletesLocked   int              `json:"deletes_skipped_locked"`
+	// NextContinuationToken is only present for -continuation-token and
+	// -max-files runs, and is empty once the prefix is fully listed.
+	NextContinuationToken *string `json:"next_continuation_token,omitempty"`
+	// Unverifiable counts the failures -require-checksum had no checksum
+	// for; they are among Failed too.
+	Unverifiable int `json:"unverifiable"`
+	// RetriesUsed counts download retries; RetryBudget is -retry-budget,
+	// only present when one was set.
+	RetriesUsed int  `json:"retries_used"`
+	RetryBudget *int `json:"retry_budget,omitempty"`
+	// SkippedTooLarge counts the objects left out for being larger than
+	// -max-object-size; they aren't among Objects.
+	SkippedTooLarge int `json:"skipped_too_large"`
+}
+
+type summaryFailure struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Error  string `json:"error"`
+}
+
+// report totals the outcomes; runErr is the error the run ends with.
+func (s *runSummary) report(runErr error) summaryJSON {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	finished := time.Now()
+	r := summaryJSON{Failures: []summaryFailure{}}
+	if s.compact {
+		r = s.totals
+		r.Failures = append([]summaryFailure{}, s.totals.Failures...)
+		r.NotAttempted = len(s.sizes)
+	} else {
+		for id, size := range s.sizes {
+			if err, done := s.outcomes[id]; done {
+				r.tally(id, size, err)
+			} else {
+				r.NotAttempted++
+			}
+		}
+	}
+	r.Started = s.started
+	r.Finished = finished
+	r.DurationSeconds = finished.Sub(s.started).Seconds()
+	r.Objects = s.objects
+	r.SkippedPrefixes = append([]string{}, s.skipped...)
+	r.Deleted = s.deleted
+	r.DeletesLocked = s.deleteLocked
+	r.NextContinuationToken = s.nextToken
+	r.SkippedTooLarge = s.tooLarge
+	if s.retries != nil {
+		r.RetriesUsed = int(s.retries.used.Load())
+		if s.retries.limit > 0 {
+			r.RetryBudget = &s.retries.limit
+		}
+	}
+	sort.Slice(r.Failures, func(i, j int) bool {
+		a, b := r.Failures[i], r.Failures[j]
+		return a.Bucket < b.Bucket || a.Bucket == b.Bucket && a.Key < b.Key
+	})
+	sort.Strings(r.SkippedPrefixes)
+	if runErr != nil {
+		r.Error = runErr.Error()
+	}
+	return r
+}
+
+// tally counts the outcome of object id, of size bytes, towards r.
+func (r *summaryJSON) tally(id objectID, size int64, err error) {
+	switch {
+	case err == nil:
+		r.Completed++
+		r.Bytes += size
+	case errors.Is(err, errDuplicate):
+		r.Duplicates++
+	default:
+		if errors.Is(err, errUnverifiable) {
+			r.Unverifiable++
+		}
+		r.Failed++
+		r.Failures = append(r.Failures, summaryFailure{Bucket: id.bucket, Key: id.key, Error: err.Error()})
+	}
+}
+
+// logSummary writes the human-readable form of r.
+func logSummary(logger *log.Logger, r summaryJSON) {
+	logger.Printf("Summary: %d of %d objects in place (%s), %d failed, %d not attempted, %d duplicates removed, took %s",
+		r.Completed, r.Objects, formatBytes(r.Bytes), r.Failed, r.NotAttempted, r.Duplicates, time.Duration(r.DurationSeconds*float64(time.Second)).Round(time.Millisecond))
+	if len(r.SkippedPrefixes) > 0 {
+		logger.Printf("Summary: %d prefix(es) could not be listed", len(r.SkippedPrefixes))
+	}
+	if r.RetryBudget != nil {
+		logger.Printf("Summary: %d of the retry budget of %d used", r.RetriesUsed, *r.RetryBudget)
+	}
+	if r.SkippedTooLarge > 0 {
+		logger.Printf("Summary: %d object(s) skipped for being larger than -max-object-size", r.SkippedTooLarge)
+	}
+	if r.Unverifiable > 0 {
+		logger.Printf("Summary: %d object(s) failed because S3 has no checksum to verify them against", r.Unverifiable)
+	}
+	if r.Deleted > 0 || r.DeletesLocked > 0 {
+		logger.Printf("Summary: %d object(s) deleted from S3, %d kept by Object Lock", r.Deleted, r.DeletesLocked)
+	}
+	if token := r.NextContinuationToken; token != nil {
+		if *token == "" {
+			logger.Printf("Summary: the listing reached the end of the prefix")
+		} else {
+			logger.Printf("Summary: resume the listing with -continuation-token %s", *token)
+		}
+	}
+}
+
+// writeSummaryJSON writes r as one JSON object to path, or to stdout when
+// path is "-".
+func writeSummaryJSON(path string, r summaryJSON) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = writeFileAtomic(path, data)
+	}
+	if err != nil {
+		return fmt.Errorf("write summary: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// tokenPattern matches {name} placeholders in an -output-template.
+var tokenPattern = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// metaTokenPrefix introduces a user metadata token such as {meta:rig-id}.
+const metaTokenPrefix = "meta:"
+
+// outputTemplate renders the local path for a key from -output-template.
+// Built-in tokens are {key}, {basename} and {dir}; with -output-regex, its
+// capture groups are available by number ({1}) or by name ({date}).
+// {meta:name} is the object's x-amz-meta-name user metadata, which has to be
+// fetched with loadMetadata before rendering.
+type outputTemplate struct {
+	text string
+	re   *regexp.Regexp
+
+	// metaNames are the metadata keys the template uses; meta holds their
+	// values per object key once loaded.
+	metaNames []string
+	meta      map[string]map[string]string
+
+	// strip, for -strip-prefix, is removed from the start of every key
+	// that has it, which then maps to the rest; text is unused.
+	strip string
+}
+
+// stripPrefixTemplate maps every key under prefix to the part after it,
+// and every other key to itself.
+func stripPrefixTemplate(prefix string) *outputTemplate {
+	return &outputTemplate{strip: prefix}
+}
+
+// stripped returns key with t.strip removed, and whether it had it. Only
+// whole path components are removed: miner_data/2025/10/ strips
+// miner_data/2025/10/20/x.json.gz but not miner_data/2025/100/x.json.gz,
+// and a strip prefix without a trailing slash must be followed by one. A
+// key that is nothing but the prefix keeps its full path.
+func (t *outputTemplate) stripped(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, t.strip)
+	if !ok || !strings.HasSuffix(t.strip, "/") && !strings.HasPrefix(rest, "/") {
+		return key, false
+	}
+	rest = strings.TrimLeft(rest, "/")
+	if rest == "" {
+		return key, false
+	}
+	return rest, true
+}
+
+// unstripped counts the keys -strip-prefix leaves unchanged.
+func (t *outputTemplate) unstripped(keys []string) int {
+	n := 0
+	for _, key := range keys {
+		if _, ok := t.stripped(key); !ok {
+			n++
+		}
+	}
+	return n
+}
+
+func parseOutputTemplate(text, pattern string) (*outputTemplate, error) {
+	t := &outputTemplate{text: text}
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -output-regex: %w", err)
+		}
+		t.re = re
+	}
+
+	for _, m := range tokenPattern.FindAllStringSubmatch(text, -1) {
+		if name, ok := metaName(m[1]); ok {
+			if name == "" {
+				return nil, fmt.Errorf("invalid -output-template: empty metadata name in {%s}", m[1])
+			}
+			t.metaNames = append(t.metaNames, name)
+			continue
+		}
+		if !t.knownToken(m[1]) {
+			return nil, fmt.Errorf("invalid -output-template: unknown token {%s}", m[1])
+		}
+	}
+	return t, nil
+}
+
+// metaName returns the metadata key a {meta:...} token refers to. S3 hands
+// user metadata back lower-cased and without the x-amz-meta- prefix, so the
+// name is normalized the same way.
+func metaName(token string) (string, bool) {
+	name, ok := strings.CutPrefix(token, metaTokenPrefix)
+	if !ok {
+		return "", false
+	}
+	name = strings.ToLower(name)
+	return strings.TrimPrefix(name, "x-amz-meta-"), true
+}
+
+// needsMetadata reports whether rendering depends on user metadata.
+func (t *outputTemplate) needsMetadata() bool {
+	return len(t.metaNames) > 0
+}
+
+// loadMetadata fetches the metadata the template uses for every object with
+// one HeadObject each, at most workers at a time, replacing whatever was
+// loaded before. An object missing one of the keys fails when rendered.
+func (t *outputTemplate) loadMetadata(ctx context.Context, logger *log.Logger, svc *s3.Client, bucket string, objects []types.Object, workers int) error {
+	logger.Printf("Reading metadata of %d objects for -output-template (one HEAD request each)", len(objects))
+
+	var mu sync.Mutex
+	meta := make(map[string]map[string]string, len(objects))
+	err := headObjects(ctx, svc, bucket, objects, workers, func(i int, out *s3.HeadObjectOutput) {
+		values := make(map[string]string, len(t.metaNames))
+		for k, v := range out.Metadata {
+			values[strings.ToLower(k)] = v
+		}
+		mu.Lock()
+		meta[aws.ToString(objects[i].Key)] = values
+		mu.Unlock()
+	})
+	t.meta = meta
+	return err
+}
+
+func (t *outputTemplate) knownToken(name string) bool {
+	switch name {
+	case "key", "basename", "dir":
+		return true
+	}
+	if t.re == nil {
+		return false
+	}
+	if n, err := strconv.Atoi(name); err == nil {
+		return n >= 0 && n <= t.re.NumSubexp()
+	}
+	return t.re.SubexpIndex(name) >= 0
+}
+
+// render returns the slash-separated relative path for key.
+func (t *outputTemplate) render(key string) (string, error) {
+	if t.strip != "" {
+		rel, _ := t.stripped(key)
+		return rel, nil
+	}
+	var groups []string
+	if t.re != nil {
+		if groups = t.re.FindStringSubmatch(key); groups == nil {
+			return "", fmt.Errorf("key %s does not match -output-regex", key)
+		}
+	}
+
+	for _, name := range t.metaNames {
+		if _, ok := t.meta[key][name]; !ok {
+			return "", fmt.Errorf("key %s has no x-amz-meta-%s metadata", key, name)
+		}
+	}
+
+	dir := path.Dir(key)
+	if dir == "." {
+		dir = ""
+	}
+	return tokenPattern.ReplaceAllStringFunc(t.text, func(tok string) string {
+		name := tok[1 : len(tok)-1]
+		if meta, ok := metaName(name); ok {
+			return t.meta[key][meta]
+		}
+		switch name {
+		case "key":
+			return key
+		case "basename":
+			return path.Base(key)
+		case "dir":
+			return dir
+		}
+		if n, err := strconv.Atoi(name); err == nil {
+			return groups[n]
+		}
+		return groups[t.re.SubexpIndex(name)]
+	}), nil
+}
+
+// targetPath is the local file for key under localDir: the key itself, or
+// the rendered template when one is set. Either way the result must stay
+// inside localDir. The check runs on the slash-separated form, before any
+// platform-specific rewriting in localPath.
+func targetPath(localDir, key string, tmpl *outputTemplate) (string, error) {
+	rel := key
+	if tmpl != nil {
+		var err error
+		if rel, err = tmpl.render(key); err != nil {
+			return "", err
+		}
+	}
+
+	clean := path.Clean(rel)
+	if path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("local path %q for key %s is outside %s", rel, key, localDir)
+	}
+	return localPath(localDir, clean), nil
+}
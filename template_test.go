@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestStripPrefixWholeComponents(t *testing.T) {
+	tests := []struct {
+		strip, key, want string
+		ok               bool
+	}{
+		{"miner_data/2025/10/", "miner_data/2025/10/20/x.json.gz", "20/x.json.gz", true},
+		{"miner_data/2025/10", "miner_data/2025/10/20/x.json.gz", "20/x.json.gz", true},
+		{"miner_data/2025/10", "miner_data/2025/100/x.json.gz", "miner_data/2025/100/x.json.gz", false},
+		{"miner_data/2025/1", "miner_data/2025/10/x.json.gz", "miner_data/2025/10/x.json.gz", false},
+		{"miner_data/", "other/x.json.gz", "other/x.json.gz", false},
+		{"miner_data/", "miner_data/", "miner_data/", false},
+	}
+	for _, tt := range tests {
+		got, ok := stripPrefixTemplate(tt.strip).stripped(tt.key)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("strip %q from %q = %q, %v, want %q, %v", tt.strip, tt.key, got, ok, tt.want, tt.ok)
+		}
+	}
+	tmpl := stripPrefixTemplate("miner_data/2025/10")
+	if n := tmpl.unstripped([]string{"miner_data/2025/10/a.json.gz", "miner_data/2025/100/b.json.gz"}); n != 1 {
+		t.Errorf("unstripped = %d, want the partial component match counted", n)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// transformCommand pipes decompressed content through a shell command, for
+// -transform: the content is the command's stdin and its stdout becomes the
+// output file. At most cap(slots) commands run at once, however many files
+// are being decompressed.
+type transformCommand struct {
+	command string
+	slots   chan struct{}
+}
+
+func newTransformCommand(command string, workers int) *transformCommand {
+	return &transformCommand{command: command, slots: make(chan struct{}, workers)}
+}
+
+// stderrTail keeps the last bytes a command writes to stderr, enough to say
+// why it failed without holding on to everything a chatty one prints.
+type stderrTail struct {
+	buf []byte
+}
+
+const stderrTailSize = 4 << 10
+
+func (t *stderrTail) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > stderrTailSize {
+		t.buf = t.buf[len(t.buf)-stderrTailSize:]
+	}
+	return len(p), nil
+}
+
+// run streams r through the command into w, so neither side is held in
+// memory, and fails if the command exits non-zero. path is the file being
+// decompressed, given to the command as S3DOWNLOADER_FILE.
+func (t *transformCommand) run(path string, w io.Writer, r io.Reader) error {
+	t.slots <- struct{}{}
+	defer func() { <-t.slots }()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", t.command)
+	} else {
+		cmd = exec.Command("sh", "-c", t.command)
+	}
+	cmd.Env = append(cmd.Environ(), "S3DOWNLOADER_FILE="+path)
+	cmd.Stdin = r
+	cmd.Stdout = w
+	var stderr stderrTail
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	msg := strings.TrimSpace(string(stderr.buf))
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && msg != "" {
+		return fmt.Errorf("transform %q: %w: %s", t.command, err, msg)
+	}
+	return fmt.Errorf("transform %q: %w", t.command, err)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// verifyReport is the outcome of comparing localDir against a listing.
+type verifyReport struct {
+	matched    int
+	unverified []string // decompressed locally, so there's nothing to compare
+	missing    []string
+	mismatched []string
+	extra      []string
+}
+
+func (r verifyReport) ok() bool {
+	return len(r.missing) == 0 && len(r.mismatched) == 0 && len(r.extra) == 0
+}
+
+// verifyLocal checks that every listed object has a local copy of the same
+// size and, with checkMD5, the same MD5 as its ETag. Local files that don't
+// belong to any listed object are reported as extra. An object whose .gz has
+// already been replaced by its decompressed output counts as present but
+// unverified, since the compressed bytes are gone.
+func verifyLocal(logger *log.Logger, localDir string, objects []types.Object, tmpl *outputTemplate, suffix string, checkMD5 bool) (verifyReport, error) {
+	var report verifyReport
+
+	renamed := localRenames(localDir, objects, tmpl)
+	for _, obj := range objects {
+		key := aws.ToString(obj.Key)
+		path, err := targetPath(localDir, key, tmpl)
+		if err != nil {
+			report.missing = append(report.missing, key)
+			logger.Printf("Missing %s: %v", key, err)
+			continue
+		}
+		if alt, ok := renamed[key]; ok {
+			path = alt
+		}
+		decompressed := decompressedName(path, suffix)
+
+		info, err := os.Stat(path)
+		if err != nil {
+			if _, derr := os.Stat(decompressed); decompressed != path && derr == nil {
+				report.unverified = append(report.unverified, key)
+				continue
+			}
+			report.missing = append(report.missing, key)
+			logger.Printf("Missing %s: %s not found", key, path)
+			continue
+		}
+
+		if info.Size() != aws.ToInt64(obj.Size) {
+			report.mismatched = append(report.mismatched, key)
+			logger.Printf("Size mismatch for %s: local %d bytes, S3 %d bytes", key, info.Size(), aws.ToInt64(obj.Size))
+			continue
+		}
+		if want, ok := etagMD5(aws.ToString(obj.ETag)); checkMD5 && ok {
+			got, err := fileMD5(path)
+			if err != nil {
+				return report, err
+			}
+			if got != want {
+				report.mismatched = append(report.mismatched, key)
+				logger.Printf("MD5 mismatch for %s: local %s, ETag %s", key, got, want)
+				continue
+			}
+		}
+		report.matched++
+	}
+
+	extra, err := extraneousFiles(localDir, objects, tmpl, suffix)
+	for _, path := range extra {
+		logger.Printf("Extra local file %s", path)
+	}
+	report.extra = extra
+	return report, err
+}
+
+// extraneousFiles returns the files under localDir that no listed object
+// maps to, either as its download or as the decompressed output of one.
+func extraneousFiles(localDir string, objects []types.Object, tmpl *outputTemplate, suffix string) ([]string, error) {
+	expected := make(map[string]bool, 2*len(objects))
+	renamed := localRenames(localDir, objects, tmpl)
+	for _, obj := range objects {
+		path, err := targetPath(localDir, aws.ToString(obj.Key), tmpl)
+		if err != nil {
+			continue
+		}
+		if alt, ok := renamed[aws.ToString(obj.Key)]; ok {
+			path = alt
+		}
+		expected[path] = true
+		expected[decompressedName(path, suffix)] = true
+	}
+
+	var extra []string
+	err := filepath.WalkDir(localDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && !expected[path] {
+			extra = append(extra, path)
+		}
+		return nil
+	})
+	return extra, err
+}
+
+// deleteExtraneous removes local files that no listed object maps to. Unless
+// confirmed it only logs what it would remove.
+func deleteExtraneous(logger *log.Logger, localDir string, objects []types.Object, tmpl *outputTemplate, suffix string, confirmed bool) error {
+	extra, err := extraneousFiles(localDir, objects, tmpl, suffix)
+	if err != nil {
+		return fmt.Errorf("scan %s: %w", localDir, err)
+	}
+	if !confirmed {
+		for _, path := range extra {
+			logger.Printf("Would delete %s", path)
+		}
+		if len(extra) > 0 {
+			logger.Printf("%d extraneous file(s) found; pass -yes to delete them", len(extra))
+		}
+		return nil
+	}
+
+	var errs []error
+	for _, path := range extra {
+		if err := os.Remove(path); err != nil {
+			errs = append(errs, err)
+			logger.Printf("Failed to delete %s: %v", path, err)
+			continue
+		}
+		logger.Printf("Deleted %s", path)
+	}
+	return errors.Join(errs...)
+}
+
+// etagMD5 returns the MD5 hex digest an ETag stands for. Multipart and
+// SSE-KMS ETags aren't MD5s of the content and report false.
+func etagMD5(etag string) (string, bool) {
+	etag = strings.Trim(etag, `"`)
+	if len(etag) != 2*md5.Size || strings.Contains(etag, "-") {
+		return "", false
+	}
+	return strings.ToLower(etag), true
+}
+
+func fileMD5(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("hash %s: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// localRenames is where downloadFiles puts the objects whose local paths
+// collide by case, assuming the default -case-collisions=rename. It is empty
+// unless localDir is case-insensitive.
+func localRenames(localDir string, objects []types.Object, tmpl *outputTemplate) map[string]string {
+	if insensitive, err := caseInsensitive(localDir); err != nil || !insensitive {
+		return nil
+	}
+	return caseCollisions(localDir, objectKeys(objects), tmpl)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// objectVersion is one entry of ListObjectVersions: a version of an object
+// or a delete marker.
+type objectVersion struct {
+	key          string
+	versionID    string
+	latest       bool
+	deleteMarker bool
+	size         int64
+	etag         string
+	lastModified time.Time
+}
+
+// listVersions returns every version and delete marker under prefix,
+// ordered by key and then newest first, as S3 lists them. Like the normal
+// listing, only matchSuffix keys are kept unless includeNonMatching.
+func listVersions(ctx context.Context, svc *s3.Client, bucket, prefix string, includeNonMatching bool) ([]objectVersion, error) {
+	var versions []objectVersion
+	keep := func(key string) bool {
+		return includeNonMatching || strings.HasSuffix(key, matchSuffix)
+	}
+
+	paginator := s3.NewListObjectVersionsPaginator(svc, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("list object versions under %q: %w", prefix, err)
+		}
+		for _, v := range page.Versions {
+			if key := aws.ToString(v.Key); keep(key) {
+				versions = append(versions, objectVersion{
+					key:          key,
+					versionID:    aws.ToString(v.VersionId),
+					latest:       aws.ToBool(v.IsLatest),
+					size:         aws.ToInt64(v.Size),
+					etag:         aws.ToString(v.ETag),
+					lastModified: aws.ToTime(v.LastModified),
+				})
+			}
+		}
+		for _, m := range page.DeleteMarkers {
+			if key := aws.ToString(m.Key); keep(key) {
+				versions = append(versions, objectVersion{
+					key:          key,
+					versionID:    aws.ToString(m.VersionId),
+					latest:       aws.ToBool(m.IsLatest),
+					deleteMarker: true,
+					lastModified: aws.ToTime(m.LastModified),
+				})
+			}
+		}
+	}
+
+	// Each page keeps versions and delete markers apart, so interleave them
+	// again.
+	sort.SliceStable(versions, func(i, j int) bool {
+		a, b := versions[i], versions[j]
+		if a.key != b.key {
+			return a.key < b.key
+		}
+		return a.lastModified.After(b.lastModified)
+	})
+	return versions, nil
+}
+
+// printVersions writes one line per version: key, version ID, whether it is
+// the latest, its size, and when it was written. Delete markers have no size
+// and say so instead.
+func printVersions(w io.Writer, versions []objectVersion) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tVERSION ID\tLATEST\tSIZE\tLAST MODIFIED")
+	for _, v := range versions {
+		size := formatBytes(v.size)
+		if v.deleteMarker {
+			size = "(delete marker)"
+		}
+		latest := ""
+		if v.latest {
+			latest = "latest"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", v.key, v.versionID, latest, size, v.lastModified.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+// recoverableObjects lists the newest version of every key under prefixes
+// that still has one, for -recover-deleted: the current object for a live
+// key, and the version before the delete marker for a deleted one. The
+// returned map holds the version ID to fetch for each recovered key.
+func recoverableObjects(ctx context.Context, logger *log.Logger, svc *s3.Client, bucket string, prefixes []string, includeNonMatching bool) ([]types.Object, map[string]string, error) {
+	var objects []types.Object
+	recovered := make(map[string]string)
+	for _, prefix := range prefixes {
+		versions, err := listVersions(ctx, svc, bucket, prefix, includeNonMatching)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := 0; i < len(versions); {
+			key := versions[i].key
+			deleted := false
+			var newest *objectVersion
+			for ; i < len(versions) && versions[i].key == key; i++ {
+				// Go by IsLatest rather than position: a delete marker
+				// written in the same second as the version it hides can
+				// sort either side of it.
+				v := &versions[i]
+				switch {
+				case v.latest && v.deleteMarker:
+					deleted = true
+				case v.latest:
+					newest = v
+				case newest == nil && !v.deleteMarker:
+					newest = v
+				}
+			}
+			if newest == nil {
+				continue
+			}
+			objects = append(objects, types.Object{
+				Key:          aws.String(key),
+				ETag:         aws.String(newest.etag),
+				Size:         aws.Int64(newest.size),
+				LastModified: aws.Time(newest.lastModified),
+			})
+			if deleted {
+				recovered[key] = newest.versionID
+				logger.Printf("Recovering deleted %s from version %s (%s)", key, newest.versionID, newest.lastModified.Format(time.RFC3339))
+			}
+		}
+	}
+	logger.Printf("%d of %d keys are deleted and will be recovered from an earlier version", len(recovered), len(objects))
+	return objects, recovered, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestRecoverableObjectsUseLatestFlag(t *testing.T) {
+	// Each delete marker shares its LastModified with the version it hides,
+	// so sorting alone can't tell which is current.
+	const listing = `<?xml version="1.0" encoding="UTF-8"?>
+<ListVersionsResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
+<Name>bucket</Name><IsTruncated>false</IsTruncated>
+<Version><Key>a.json.gz</Key><VersionId>a2</VersionId><IsLatest>false</IsLatest><LastModified>2025-10-20T10:00:00.000Z</LastModified><ETag>"a2"</ETag><Size>10</Size></Version>
+<Version><Key>a.json.gz</Key><VersionId>a1</VersionId><IsLatest>false</IsLatest><LastModified>2025-10-20T09:00:00.000Z</LastModified><ETag>"a1"</ETag><Size>9</Size></Version>
+<Version><Key>b.json.gz</Key><VersionId>b2</VersionId><IsLatest>true</IsLatest><LastModified>2025-10-20T10:00:00.000Z</LastModified><ETag>"b2"</ETag><Size>20</Size></Version>
+<DeleteMarker><Key>a.json.gz</Key><VersionId>am</VersionId><IsLatest>true</IsLatest><LastModified>2025-10-20T10:00:00.000Z</LastModified></DeleteMarker>
+<DeleteMarker><Key>b.json.gz</Key><VersionId>bm</VersionId><IsLatest>false</IsLatest><LastModified>2025-10-20T10:00:00.000Z</LastModified></DeleteMarker>
+</ListVersionsResult>`
+	svc := newStubClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write([]byte(listing))
+	}))
+
+	objects, recovered, err := recoverableObjects(context.Background(), discardLogger(), svc, "bucket", []string{""}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 {
+		t.Fatalf("got %d objects, want 2", len(objects))
+	}
+	if got := recovered["a.json.gz"]; got != "a2" {
+		t.Errorf("a.json.gz recovered from %q, want a2", got)
+	}
+	if got, ok := recovered["b.json.gz"]; ok {
+		t.Errorf("live b.json.gz recovered from %q", got)
+	}
+}